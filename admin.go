@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// set by POST /admin/drain, captures get a 503 until POST /admin/resume
+var draining atomic.Bool
+
+const drainingMessage = "Sensor is down for maintenance, try again later"
+
+// drainMiddleWare turns captures away while the server is drained, the ones
+// already running finish. Same while it waits for the sensor at startup
+func drainMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, drainingMessage, http.StatusServiceUnavailable)
+			return
+		}
+		if waitingForSensor.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(sensorPollInterval.Seconds())))
+			http.Error(w, waitingForSensorMessage, http.StatusServiceUnavailable)
+			return
+		}
+		callback(w, r)
+	}
+}
+
+// adminMiddleWare is authMiddleWare, except without -api-key or -basic-auth
+// the admin endpoints are off instead of open to anyone
+func adminMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authRequired() {
+			http.Error(w, "Admin endpoints need credentials, set -api-key or -basic-auth", http.StatusForbidden)
+			return
+		}
+		authMiddleWare(callback)(w, r)
+	}
+}
+
+// HandleDrain stops new captures, /readyz goes red so load balancers move
+// on but /healthz stays up
+func HandleDrain(w http.ResponseWriter, r *http.Request) {
+	if !draining.Swap(true) {
+		slog.Warn("drained, captures are turned away until /admin/resume", "event", "drain")
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": true})
+}
+
+// HandleResume takes captures again after HandleDrain
+func HandleResume(w http.ResponseWriter, r *http.Request) {
+	if draining.Swap(false) {
+		slog.Info("resumed, taking captures again", "event", "resume")
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": false})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// when set, protected endpoints need it as a bearer token or X-API-Key
+var apiKey string
+
+// -basic-auth, user and bcrypt hash of its password. With -api-key too
+// either one gets in
+var (
+	basicAuthUser string
+	basicAuthHash []byte
+)
+
+// parseBasicAuth splits -basic-auth's user:hash, the hash has to be bcrypt
+func parseBasicAuth(s string) (user string, hash []byte, err error) {
+	user, h, ok := strings.Cut(s, ":")
+	if !ok || user == "" || h == "" {
+		return "", nil, errors.New("want user:bcrypthash")
+	}
+	if _, err := bcrypt.Cost([]byte(h)); err != nil {
+		return "", nil, errors.New("password isn't a bcrypt hash, make one with htpasswd -nbB user password")
+	}
+	return user, []byte(h), nil
+}
+
+// authRequired is whether any credentials are configured, without them the
+// protected endpoints are open
+func authRequired() bool {
+	return apiKey != "" || basicAuthUser != ""
+}
+
+// authMiddleWare rejects requests without the api key or basic auth, with
+// neither configured everything stays open like it always was. A signed url
+// from /admin/sign stands in for them, a bad or spent one is a 403
+func authMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("sig") {
+			if err := checkSignedURL(r); err != nil {
+				http.Error(w, "Forbidden, "+err.Error(), http.StatusForbidden)
+				return
+			}
+			callback(w, r)
+			return
+		}
+		if authRequired() && !validAPIKey(r) && !validBasicAuth(r) {
+			unauthorized(w)
+			return
+		}
+		callback(w, r)
+	}
+}
+
+// unauthorized is the 401 with a challenge for every kind of credentials
+// that's configured
+func unauthorized(w http.ResponseWriter) {
+	msg := "Missing or invalid API key"
+	if basicAuthUser != "" {
+		w.Header().Add("WWW-Authenticate", `Basic realm="fingerprint", charset="UTF-8"`)
+		msg = "Missing or invalid credentials"
+	}
+	if apiKey != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="fingerprint"`)
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+func validAPIKey(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = bearer
+	}
+	return checkAPIKey(key)
+}
+
+func checkAPIKey(key string) bool {
+	return apiKey != "" && key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1
+}
+
+func validBasicAuth(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	return ok && checkBasicAuth(user, pass)
+}
+
+// checkBasicAuth runs bcrypt even for the wrong user, so the time it takes
+// doesn't tell which users exist
+func checkBasicAuth(user, pass string) bool {
+	if basicAuthUser == "" {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(basicAuthUser)) == 1
+	passOK := bcrypt.CompareHashAndPassword(basicAuthHash, []byte(pass)) == nil
+	return userOK && passOK
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	// how much darker or lighter than the platen a pixel has to be to be finger
+	autocropThreshold = 48
+	// kept around the finger so the edge ridges aren't cut
+	autocropPadding = 16
+)
+
+// foregroundBox is the bounding box of what isn't platen in src, plus
+// autocropPadding. The platen shade is taken from the image border. A row
+// or column needs 1% of its pixels to be finger to count, so specks of dust
+// don't stretch the box. ok is false when there's no finger at all
+func foregroundBox(src image.Image) (box image.Rectangle, ok bool) {
+	b := src.Bounds()
+	if b.Dx() < 3 || b.Dy() < 3 {
+		return image.Rectangle{}, false
+	}
+	gray := func(x, y int) int {
+		return int(color.GrayModel.Convert(src.At(x, y)).(color.Gray).Y)
+	}
+
+	sum, n := 0, 0
+	for x := b.Min.X; x < b.Max.X; x++ {
+		sum += gray(x, b.Min.Y) + gray(x, b.Max.Y-1)
+		n += 2
+	}
+	for y := b.Min.Y + 1; y < b.Max.Y-1; y++ {
+		sum += gray(b.Min.X, y) + gray(b.Max.X-1, y)
+		n += 2
+	}
+	platen := sum / n
+
+	rows := make([]int, b.Dy())
+	cols := make([]int, b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if d := gray(x, y) - platen; d > autocropThreshold || d < -autocropThreshold {
+				rows[y-b.Min.Y]++
+				cols[x-b.Min.X]++
+			}
+		}
+	}
+	top, bottom, found := span(rows, max(1, b.Dx()/100))
+	if !found {
+		return image.Rectangle{}, false
+	}
+	left, right, _ := span(cols, max(1, b.Dy()/100))
+
+	box = image.Rect(left-autocropPadding, top-autocropPadding, right+1+autocropPadding, bottom+1+autocropPadding)
+	return box.Add(b.Min).Intersect(b), true
+}
+
+// span is the first and last index of counts that's at least min
+func span(counts []int, min int) (first, last int, ok bool) {
+	first = -1
+	for i, c := range counts {
+		if c >= min {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	return first, last, first >= 0
+}
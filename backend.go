@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// the name ?backend= uses for -script, the primary backend
+const primaryBackend = "default"
+
+var errUnknownBackend = errors.New("unknown backend")
+
+// BackendConfig is a capture script for another kind of sensor, from the
+// backends list of the config file
+type BackendConfig struct {
+	Name   string `yaml:"name" toml:"name"`
+	Script string `yaml:"script" toml:"script"`
+	// empty is the python -python picks
+	Python string   `yaml:"python" toml:"python"`
+	Args   []string `yaml:"args" toml:"args"`
+}
+
+// backend is a BackendConfig ready to capture with. It has its own sensor
+// lock, it's another device, and never goes through the -worker pool
+type backend struct {
+	name   string
+	script string
+	python string
+	args   []string
+	lock   *sensorMutex
+}
+
+// the backends besides the primary one, by name
+var backends = map[string]*backend{}
+
+// setupBackends resolves the script of every backend, a missing one is an
+// error unless the server only mocks captures
+func setupBackends(configs []BackendConfig) error {
+	for _, c := range configs {
+		script, err := filepath.Abs(c.Script)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", c.Name, err)
+		}
+		python, err := absCommand(c.Python)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", c.Name, err)
+		}
+		if !mockCapture {
+			if _, err := os.Stat(script); err != nil {
+				return fmt.Errorf("backend %s: capture script: %w", c.Name, err)
+			}
+			if python != "" {
+				if _, err := exec.LookPath(python); err != nil {
+					return fmt.Errorf("backend %s: python isn't executable: %w", c.Name, err)
+				}
+			}
+		}
+		backends[c.Name] = &backend{name: c.Name, script: script, python: python, args: c.Args, lock: newSensorMutex()}
+	}
+	return nil
+}
+
+func (b *backend) pythonExecutable() string {
+	if b.python != "" {
+		return b.python
+	}
+	return pythonExecutable()
+}
+
+// capture is runCapture for b
+func (b *backend) capture(ctx context.Context, timeout time.Duration, args []string) (*captureResult, error) {
+	if mockCapture {
+		return runMock(args)
+	}
+	defer useSensor(ctx)()
+	return runLocked(ctx, timeout, b.lock, b.pythonExecutable(), b.script, append(slices.Clip(args), b.args...))
+}
+
+// requestBackend is ?backend=, "" for the primary one
+func requestBackend(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("backend")
+	if name == "" || name == primaryBackend {
+		return "", nil
+	}
+	if _, ok := backends[name]; !ok {
+		return "", fmt.Errorf("%w %q", errUnknownBackend, name)
+	}
+	return name, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultBatchCount = 3
+	maxBatchCount     = 10
+)
+
+// batchFrame is one capture of a batch, Error is set when it failed
+type batchFrame struct {
+	Index   int    `json:"index"`
+	Quality *int   `json:"quality,omitempty"`
+	Error   string `json:"error,omitempty"`
+	image   []byte
+}
+
+// HandleCaptureBatch captures ?count= prints in a row, for liveness checks
+// or picking the best one. They come back as multipart/mixed or, with
+// Accept: application/zip, as a zip. Failed captures are left out and
+// counted in X-Batch-Failed
+func HandleCaptureBatch(w http.ResponseWriter, r *http.Request) {
+	count := defaultBatchCount
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid count %q", v), http.StatusBadRequest)
+			return
+		}
+		count = min(n, maxBatchCount)
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	contentType, ok := formats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported format %q, want png, jpeg, bmp or wsq", format), http.StatusBadRequest)
+		return
+	}
+
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Capture-Timeout", timeout.String())
+	device, err := requestDevice(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var frames []batchFrame
+	var firstErr error
+	failed := 0
+	for i := range count {
+		done := trackCapture()
+		img, meta, err := capturer.Capture(r.Context(), CaptureOptions{Format: format, Device: device, Timeout: timeout})
+		done(err)
+		if err != nil {
+			if r.Context().Err() != nil {
+				logError(r, err)
+				return
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			_, msg := captureStatus(err)
+			frames = append(frames, batchFrame{Index: i, Error: msg})
+			continue
+		}
+		saveCapture(r.Context(), img, meta.CapturedAt, format)
+		frames = append(frames, batchFrame{Index: i, Quality: meta.Quality, image: img})
+	}
+
+	if failed == count {
+		logError(r, firstErr)
+		status, msg := captureStatus(firstErr)
+		http.Error(w, msg, status)
+		return
+	}
+	if failed > 0 {
+		logError(r, fmt.Errorf("%d of %d captures failed, first: %w", failed, count, firstErr))
+	}
+
+	var body bytes.Buffer
+	if strings.Contains(r.Header.Get("Accept"), "application/zip") {
+		if err := writeBatchZip(&body, frames, format); err != nil {
+			logError(r, err)
+			http.Error(w, "Failed to build zip", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		mw := multipart.NewWriter(&body)
+		if err := writeBatchMultipart(mw, frames, format, contentType); err != nil {
+			logError(r, err)
+			http.Error(w, "Failed to build multipart answer", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("X-Batch-Count", strconv.Itoa(count))
+	w.Header().Set("X-Batch-Failed", strconv.Itoa(failed))
+	w.Write(body.Bytes())
+}
+
+// writeBatchMultipart writes one part per successful frame, index and
+// quality are part headers
+func writeBatchMultipart(mw *multipart.Writer, frames []batchFrame, format, contentType string) error {
+	for _, f := range frames {
+		if f.image == nil {
+			continue
+		}
+		h := textproto.MIMEHeader{
+			"Content-Type":        {contentType},
+			"Content-Disposition": {fmt.Sprintf(`attachment; filename="frame-%d.%s"`, f.Index, format)},
+			"X-Frame-Index":       {strconv.Itoa(f.Index)},
+		}
+		if f.Quality != nil {
+			h.Set("X-Fingerprint-Quality", strconv.Itoa(*f.Quality))
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(f.image); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// writeBatchZip writes frame-<index>.<format> for every successful frame and
+// a frames.json with the index, quality or error of all of them
+func writeBatchZip(buf *bytes.Buffer, frames []batchFrame, format string) error {
+	zw := zip.NewWriter(buf)
+	for _, f := range frames {
+		if f.image == nil {
+			continue
+		}
+		// the images are compressed already
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("frame-%d.%s", f.Index, format), Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(f.image); err != nil {
+			return err
+		}
+	}
+	fw, err := zw.Create("frames.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(fw).Encode(frames); err != nil {
+		return err
+	}
+	return zw.Close()
+}
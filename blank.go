@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+var errBlankCapture = errors.New("no finger detected, the scan is blank")
+
+// -blank-threshold, a capture with more than this share of its pixels close
+// to one shade is a sensor that saw no finger. 0 turns the check off
+var blankThreshold = 0.98
+
+// how far from the median a pixel may be and still count as the same shade
+const blankTolerance = 16
+
+// uniformShare is the share of img's pixels within blankTolerance of its
+// median gray
+func uniformShare(img []byte) (float64, error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return 0, err
+	}
+	b := src.Bounds()
+	if b.Empty() {
+		return 1, nil
+	}
+	var hist [256]int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[color.GrayModel.Convert(src.At(x, y)).(color.Gray).Y]++
+		}
+	}
+	total := b.Dx() * b.Dy()
+	median, seen := 0, 0
+	for ; median < 255; median++ {
+		if seen += hist[median]; seen*2 >= total {
+			break
+		}
+	}
+	uniform := 0
+	for v := max(median-blankTolerance, 0); v <= min(median+blankTolerance, 255); v++ {
+		uniform += hist[v]
+	}
+	return float64(uniform) / float64(total), nil
+}
+
+// checkBlank fails a capture that's all one shade. What doesn't decode, like
+// wsq, isn't checked. -debug logs the coverage of every capture for tuning
+// the threshold
+func checkBlank(ctx context.Context, img []byte) error {
+	if blankThreshold <= 0 {
+		return nil
+	}
+	share, err := uniformShare(img)
+	if err != nil {
+		return nil
+	}
+	coverage := 1 - share
+	if share > blankThreshold {
+		logFor(ctx).Warn("capture is blank, no finger on the sensor", "event", "capture_blank", "coverage", coverage, "blank_threshold", blankThreshold)
+		return fmt.Errorf("%w, %.1f%% of it is one shade", errBlankCapture, share*100)
+	}
+	if debugMode {
+		logFor(ctx).Info("capture coverage", "event", "capture_coverage", "coverage", coverage)
+	}
+	return nil
+}
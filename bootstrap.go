@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// bootstrapVenv creates the venv and installs requirements.txt into it when
+// there's no venv yet, so a first run is just starting the server. Both are
+// next to the executable unless -relative-to-cwd
+func bootstrapVenv(ctx context.Context) error {
+	if _, err := os.Stat(venvPython()); err == nil {
+		slog.Info("venv is already there, not bootstrapping", "path", venvPython())
+		return nil
+	}
+
+	slog.Info("bootstrapping python venv", "event", "bootstrap")
+	if err := runLogged(ctx, systemPython(), "-m", "venv", appPath("venv")); err != nil {
+		return fmt.Errorf("creating venv: %w", err)
+	}
+	requirements := appPath("requirements.txt")
+	if _, err := os.Stat(requirements); err != nil {
+		slog.Warn("no requirements.txt, the venv stays empty")
+		return nil
+	}
+	if err := runLogged(ctx, venvPython(), "-m", "pip", "install", "-r", requirements); err != nil {
+		// a half set up venv would stop the next start from bootstrapping
+		os.RemoveAll(appPath("venv"))
+		return fmt.Errorf("installing requirements: %w", err)
+	}
+	slog.Info("python venv is ready", "event", "bootstrap_done", "path", venvPython())
+	return nil
+}
+
+// runLogged runs name with its output going to the log as it comes
+func runLogged(ctx context.Context, name string, args ...string) error {
+	slog.Info("running", "event", "bootstrap_command", "command", name+" "+strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, name, args...)
+	out := &logWriter{msg: "bootstrap output", event: "bootstrap_output", level: slog.LevelInfo}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
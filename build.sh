@@ -3,13 +3,18 @@
 
 LINUX_OUTPUT="fingerprint-server-linux"
 WINDOWS_OUTPUT="fingerprint-server-windows.exe"
-SOURCE_FILE="main.go"
+SOURCE_FILE="."
+
+VERSION="$(git describe --tags --always --dirty 2>/dev/null || echo dev)"
+COMMIT="$(git rev-parse --short HEAD 2>/dev/null)"
+BUILD_DATE="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+LDFLAGS="-w -s -X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$BUILD_DATE"
 
 echo "Starting build process..."
 
 
 echo "Compiling for Linux..."
-go build -installsuffix cgo -ldflags="-w -s" -o "$LINUX_OUTPUT" "$SOURCE_FILE"
+go build -installsuffix cgo -ldflags="$LDFLAGS" -o "$LINUX_OUTPUT" "$SOURCE_FILE"
 if [ $? -eq 0 ]; then
   echo "Successfully compiled for Linux: $LINUX_OUTPUT"
 else
@@ -20,7 +25,7 @@ fi
 echo "" 
 
 echo "Compiling for Windows..."
-env GOOS=windows GOARCH=amd64 go build -a -installsuffix cgo -ldflags="-w -s" -o "$WINDOWS_OUTPUT" "$SOURCE_FILE"
+env GOOS=windows GOARCH=amd64 go build -a -installsuffix cgo -ldflags="$LDFLAGS" -o "$WINDOWS_OUTPUT" "$SOURCE_FILE"
 if [ $? -eq 0 ]; then
   echo "Successfully compiled for Windows: $WINDOWS_OUTPUT"
 else
@@ -30,6 +35,8 @@ fi
 
 # just copying the script so I can still use hot reloading and ignore everything in build file
 cp capture.py build/capture.py
+cp match.py build/match.py
+cp template.py build/template.py
 
 echo ""
 echo "Build process complete."
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// what a ?bundle= can have, in this order in the error message
+var bundleFormats = []string{"png", "jpeg", "bmp", "wsq", "raw"}
+
+// bundleMetadata is the metadata.json of a bundle
+type bundleMetadata struct {
+	Formats    []string  `json:"formats"`
+	DPI        int       `json:"dpi"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	CapturedAt time.Time `json:"capturedAt"`
+	Quality    *int      `json:"quality,omitempty"`
+	Liveness   *int      `json:"liveness,omitempty"`
+}
+
+// parseBundle reads ?bundle=png,wsq,raw, a format named twice is there once
+func parseBundle(v string) ([]string, error) {
+	var out []string
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if !slices.Contains(bundleFormats, f) {
+			return nil, fmt.Errorf("invalid bundle format %q, want a list of %s", f, strings.Join(bundleFormats, ", "))
+		}
+		if !slices.Contains(out, f) {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// HandleCaptureBundle is /capture?bundle=, it captures once and answers with
+// a zip of that capture in every format asked for plus a metadata.json. The
+// png capture is converted here, wsq by capture.py --encode, so the sensor
+// is only used once. ?device=, ?timeout= and ?liveness=1 work like for
+// /capture, the rest is left out, an archive wants the scan as it was
+func HandleCaptureBundle(w http.ResponseWriter, r *http.Request) {
+	bundle, err := parseBundle(r.URL.Query().Get("bundle"))
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("X-Capture-Timeout", timeout.String())
+	device, err := requestDevice(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	liveness, err := requestLiveness(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	opts := CaptureOptions{Device: device, Timeout: timeout, Liveness: liveness}
+	done := trackCapture()
+	img, meta, attempts, err := captureBest(r.Context(), opts)
+	done(err)
+	if err != nil {
+		logError(r, err)
+		writeCaptureError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Capture-Timestamp", meta.CapturedAt.UTC().Format(time.RFC3339Nano))
+	debugCapture(w, r, meta, true)
+	setQualityHeaders(w, meta, attempts)
+	if opts.liveness() {
+		w.Header().Set("X-Liveness-Score", livenessHeader(meta.Liveness))
+	}
+	if meta.Quality != nil {
+		quality := *meta.Quality
+		w.Header().Set("X-Fingerprint-Quality", strconv.Itoa(quality))
+		if quality < rejectQualityBelow {
+			logError(r, fmt.Errorf("quality %d is below %d", quality, rejectQualityBelow))
+			writeAPIError(w, r, http.StatusUnprocessableEntity, codeLowQuality, fmt.Sprintf("Fingerprint quality %d is below %d, please scan again", quality, rejectQualityBelow))
+			return
+		}
+	}
+	saveCapture(r.Context(), img, meta.CapturedAt, "png")
+
+	dpi := imageDPI
+	if meta.Resolution > 0 {
+		dpi = meta.Resolution
+	}
+	width, height, _ := imageSize(img)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, format := range bundle {
+		encoded, err := encodeBundle(r.Context(), img, format, dpi)
+		if err != nil {
+			logError(r, err)
+			writeCaptureError(w, r, err)
+			return
+		}
+		// the images are compressed already, raw isn't but it's small
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: "fingerprint." + format, Method: zip.Store, Modified: meta.CapturedAt})
+		if err == nil {
+			_, err = fw.Write(encoded)
+		}
+		if err != nil {
+			logError(r, err)
+			writeAPIError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build zip")
+			return
+		}
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "metadata.json", Method: zip.Deflate, Modified: meta.CapturedAt})
+	if err == nil {
+		err = json.NewEncoder(fw).Encode(bundleMetadata{
+			Formats:    bundle,
+			DPI:        dpi,
+			Width:      width,
+			Height:     height,
+			CapturedAt: meta.CapturedAt.UTC(),
+			Quality:    meta.Quality,
+			Liveness:   meta.Liveness,
+		})
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		logError(r, err)
+		writeAPIError(w, r, http.StatusInternalServerError, codeInternal, "Failed to build zip")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="fingerprint-%s.zip"`, meta.CapturedAt.UTC().Format(saveTimeFormat)))
+	setImageSize(w.Header(), width, height)
+	w.Header().Set("X-Image-DPI", strconv.Itoa(dpi))
+	w.Write(buf.Bytes())
+}
+
+// encodeBundle is the png capture img in format
+func encodeBundle(ctx context.Context, img []byte, format string, dpi int) ([]byte, error) {
+	switch format {
+	case "png":
+		return setPNGDPI(img, dpi)
+	case "raw":
+		pix, _, _, err := rawGray(img)
+		return pix, err
+	case "wsq":
+		return encodeWSQ(ctx, img, dpi)
+	}
+	out, _, err := transform{}.apply(img, format)
+	return out, err
+}
+
+// encodeWSQ has capture.py turn the png capture img into wsq, it doesn't
+// touch the sensor
+func encodeWSQ(ctx context.Context, img []byte, dpi int) ([]byte, error) {
+	if dpi != wsqDPI {
+		return nil, fmt.Errorf("%w, wsq is for %d dpi scans and this one is %d", errBadImage, wsqDPI, dpi)
+	}
+	if mockCapture {
+		// there's no wsq encoder on this side
+		return nil, fmt.Errorf("%w, -mock can't make wsq", errBadImage)
+	}
+	path, err := writeTemp(bytes.NewReader(img), "bundle")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	out, err := runPython(ctx, captureTimeout, scriptPath, withScriptArgs([]string{"--encode", path, "--format", "wsq"})...)
+	if err != nil {
+		return nil, err
+	}
+	if got := sniffContentType(out); got != formats["wsq"] {
+		return nil, fmt.Errorf("%w, want %s, got %s", errBadImage, formats["wsq"], got)
+	}
+	return out, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// how long a successful capture is answered from memory, 0 turns the cache off
+var captureCacheTTL time.Duration
+
+// captureCache keeps the last good capture of every device, format and
+// backend so clients polling /capture don't trigger the sensor again for the
+// same finger placement. One sensor's capture is never an answer for another
+type captureCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedCapture
+}
+
+type cachedCapture struct {
+	img  []byte
+	meta Metadata
+}
+
+var lastCapture captureCache
+
+// get is the cached capture for key while it's younger than captureCacheTTL
+func (c *captureCache) get(key string) ([]byte, Metadata, bool) {
+	if captureCacheTTL <= 0 {
+		return nil, Metadata{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.meta.CapturedAt) > captureCacheTTL {
+		return nil, Metadata{}, false
+	}
+	return e.img, e.meta, true
+}
+
+// put replaces what was cached for key with img, and drops what has expired
+func (c *captureCache) put(key string, img []byte, meta Metadata) {
+	if captureCacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]cachedCapture{}
+	}
+	for k, e := range c.entries {
+		if time.Since(e.meta.CapturedAt) > captureCacheTTL {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedCapture{img: img, meta: meta}
+}
+
+// forget drops the cached capture for key, a failed capture means the finger
+// placement it was for is gone. Other devices keep theirs
+func (c *captureCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// sensorCapabilities is capture.py --capabilities plus what the server adds
+// on its side
+type sensorCapabilities struct {
+	// ?format= values, capture.py's and raw, nist and datauri when it does png
+	Formats []string `json:"formats"`
+	// ?resolution= values
+	Resolutions []int `json:"resolutions"`
+	NativeDPI   int   `json:"nativeDpi"`
+	Width       int   `json:"width"`
+	Height      int   `json:"height"`
+	// whether captures come with X-Fingerprint-Quality
+	Quality  bool `json:"quality"`
+	Liveness bool `json:"liveness"`
+	// -max-image-bytes
+	MaxImageBytes int `json:"maxImageBytes"`
+}
+
+// capabilities don't change while the server runs, so capture.py is only
+// asked once it answered
+var capabilitiesCache struct {
+	mu   sync.Mutex
+	caps *sensorCapabilities
+}
+
+// HandleSensorCapabilities says what the sensor and capture.py can do, so
+// clients don't ask for a ?format= or ?resolution= that can't work
+func HandleSensorCapabilities(w http.ResponseWriter, r *http.Request) {
+	c := &capabilitiesCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.caps == nil {
+		res, err := runCapture(r.Context(), sensorStatusTimeout, "--capabilities")
+		if err != nil {
+			logError(r, err)
+			status, msg := captureStatus(err)
+			writeJSONError(w, status, msg)
+			return
+		}
+		var caps sensorCapabilities
+		if err := json.Unmarshal(res.Image, &caps); err != nil {
+			logError(r, fmt.Errorf("capture script returned invalid capabilities json: %w", err))
+			writeJSONError(w, http.StatusInternalServerError, "capture script returned invalid capabilities json")
+			return
+		}
+		if slices.Contains(caps.Formats, "png") {
+			caps.Formats = append(caps.Formats, "raw", "nist", "datauri")
+		}
+		caps.MaxImageBytes = maxImageBytes
+		c.caps = &caps
+	}
+	writeJSON(w, http.StatusOK, c.caps)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errSensorBusy     = errors.New("sensor is busy with another capture")
+	errCaptureTimeout = errors.New("capture timed out")
+	errEmptyCapture   = errors.New("no data received from Python script")
+	errCaptureAborted = errors.New("capture aborted, the client went away")
+	errImageTooLarge  = errors.New("capture script wrote too much")
+	errNoFinger       = errors.New("no finger was placed on the sensor in time")
+	errPythonMissing  = errors.New("python or the capture script is missing")
+)
+
+// exit codes of capture.py besides 0 and the 1 of any failure. It can't be
+// 2, argparse exits with that on bad arguments. The worker says the same with
+// "noFinger": true in its answer
+const (
+	// it waited its whole timeout and no finger came, the sensor is fine
+	exitNoFinger = 3
+)
+
+// -max-image-bytes, a script writing more than this to stdout is killed
+var maxImageBytes = 4 << 20
+
+// nginx's code for a client that hung up before the answer, nobody sees it
+// but the logs
+const statusClientClosedRequest = 499
+
+// base delay between capture attempts, it grows with every retry
+const retryBackoff = 250 * time.Millisecond
+
+// how many times capture.py is run before a failure is returned
+var captureAttempts = 2
+
+// every capture.py that's running, so shutdown can wait for them to be killed
+var runningCaptures sync.WaitGroup
+
+// scriptError is capture.py exiting with an error, Stderr has the python panic
+type scriptError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *scriptError) Error() string {
+	return fmt.Sprintf("capture script failed: %v", e.Err)
+}
+
+func (e *scriptError) Unwrap() error {
+	return e.Err
+}
+
+// where the venv keeps its python, next to the executable or in the working
+// directory with -relative-to-cwd
+func venvPython() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(appPath("venv"), "Scripts", "python.exe")
+	}
+	return filepath.Join(appPath("venv"), "bin", "python3")
+}
+
+// systemPython is the python on the PATH
+func systemPython() string {
+	if runtime.GOOS == "windows" {
+		return "python"
+	}
+	return "python3"
+}
+
+// -script-args, appended to the arguments of every capture.py run
+var extraScriptArgs []string
+
+// withScriptArgs is args plus extraScriptArgs, args isn't touched
+func withScriptArgs(args []string) []string {
+	return append(slices.Clip(args), extraScriptArgs...)
+}
+
+// -script-cwd, the working directory of every script. Empty runs each one
+// in the directory it's in, so it finds the files next to it
+var scriptCwd string
+
+// scriptWorkDir is the cmd.Dir for script
+func scriptWorkDir(script string) string {
+	if scriptCwd != "" {
+		return scriptCwd
+	}
+	return filepath.Dir(script)
+}
+
+// -env, set for every script on top of what the server inherited
+var scriptEnvOverrides map[string]string
+
+// absCommand makes name absolute when it's a path, a bare name is left to
+// the PATH
+func absCommand(name string) (string, error) {
+	if name == "" || filepath.Base(name) == name {
+		return name, nil
+	}
+	return filepath.Abs(name)
+}
+
+// scriptEnv is the cmd.Env for the scripts, nil when there's nothing to add
+// so they inherit the environment as is
+func scriptEnv() []string {
+	if len(scriptEnvOverrides) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	for _, k := range slices.Sorted(maps.Keys(scriptEnvOverrides)) {
+		env = append(env, k+"="+scriptEnvOverrides[k])
+	}
+	return env
+}
+
+// -python, the interpreter every script runs with, as is. Empty picks one
+var pythonPath string
+
+// pythonExecutable is -python if set, otherwise it prefers the venv python
+// next to the server and falls back to whatever python is on the PATH
+func pythonExecutable() string {
+	if pythonPath != "" {
+		return pythonPath
+	}
+	venvPythonPath := venvPython()
+	pythonExec := systemPython()
+
+	if _, err := os.Stat(venvPythonPath); err == nil {
+		venvPythonPath, _ = filepath.Abs(venvPythonPath)
+		pythonExec = venvPythonPath
+	}
+	return pythonExec
+}
+
+// captureResult is what a successful capture.py run produced
+type captureResult struct {
+	Image []byte
+	// everything the script logged, including the QUALITY= line
+	Stderr string
+	// how long it waited for the sensor, 0 when it was free
+	Wait time.Duration
+}
+
+// Quality is the 0-100 score capture.py reports on a "QUALITY=<n>" stderr
+// line, ok is false when the script didn't report one
+func (c *captureResult) Quality() (quality int, ok bool) {
+	q, ok := c.reported("QUALITY")
+	return min(max(q, 0), 100), ok
+}
+
+// Resolution is the dpi capture.py reports on a "RESOLUTION=<n>" line, older
+// scripts don't
+func (c *captureResult) Resolution() (dpi int, ok bool) {
+	return c.reported("RESOLUTION")
+}
+
+// reported is the last "<key>=<n>" stderr line
+func (c *captureResult) reported(key string) (n int, ok bool) {
+	for _, line := range strings.Split(c.Stderr, "\n") {
+		v, found := strings.CutPrefix(strings.TrimSpace(line), key+"=")
+		if !found {
+			continue
+		}
+		if i, err := strconv.Atoi(v); err == nil {
+			n, ok = i, true
+		}
+	}
+	return n, ok
+}
+
+// captureContext is what a capture.py run gets. It's canceled with the
+// request, so a client hanging up frees the sensor right away, and when
+// shutdown kills the running captures. A zero timeout means no deadline
+func captureContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	stop := context.AfterFunc(capturesCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// runCapture runs capture.py with args while holding the sensor lock. ctx
+// only bounds the wait for the lock, the script itself gets timeout for all
+// of its attempts
+func runCapture(ctx context.Context, timeout time.Duration, args ...string) (*captureResult, error) {
+	if mockCapture {
+		return runMock(args)
+	}
+	defer useSensor(ctx)()
+	args = withScriptArgs(args)
+	if pool != nil {
+		return pool.capture(ctx, timeout, args)
+	}
+	return runLocked(ctx, timeout, sensorLock, pythonExecutable(), scriptPath, args)
+}
+
+// runLocked runs script with args while holding lock, the sensor it drives.
+// ctx and timeout work like for runCapture
+func runLocked(ctx context.Context, timeout time.Duration, lock *sensorMutex, pythonExec, script string, args []string) (*captureResult, error) {
+	wait, err := acquireLock(ctx, lock)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, abortedError(ctx)
+		}
+		logFor(ctx).Warn("sensor is busy, rejecting capture", "error", err.Error())
+		return nil, err
+	}
+	defer lock.release()
+
+	runningCaptures.Add(1)
+	defer runningCaptures.Done()
+
+	ctx, cancel := captureContext(ctx, timeout)
+	defer cancel()
+
+	var res *captureResult
+	err = retryCapture(ctx, func() (bool, error) {
+		stdout, stderr, err := runScript(ctx, timeout, pythonExec, script, args)
+		res = &captureResult{Image: stdout, Stderr: stderr, Wait: wait}
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// runPython runs one of the helper scripts that don't need the sensor, so
+// there's no lock and no retries. It returns the script's stdout
+func runPython(ctx context.Context, timeout time.Duration, script string, args ...string) ([]byte, error) {
+	runningCaptures.Add(1)
+	defer runningCaptures.Done()
+
+	ctx, cancel := captureContext(ctx, timeout)
+	defer cancel()
+
+	stdout, _, err := runScript(ctx, timeout, pythonExecutable(), script, args)
+	return stdout, err
+}
+
+func runScript(ctx context.Context, timeout time.Duration, pythonExec, script string, args []string) ([]byte, string, error) {
+	// canceled by stdoutBuf when the script writes too much
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stdoutBuf := &limitedBuffer{limit: maxImageBytes, exceeded: cancel}
+	stderr, err := runScriptTo(ctx, cmdCtx, timeout, pythonExec, script, args, stdoutBuf)
+	if err != nil {
+		return nil, "", err
+	}
+	return stdoutBuf.Bytes(), stderr, nil
+}
+
+// scriptStdout is where a script's stdout goes, it cancels the run when it
+// gets more than maxImageBytes
+type scriptStdout interface {
+	io.Writer
+	Len() int
+	String() string
+	overLimit() bool
+}
+
+// runScriptTo is runScript with stdout going to stdout, the command runs
+// under cmdCtx which stdout cancels. It returns what the script logged
+func runScriptTo(ctx, cmdCtx context.Context, timeout time.Duration, pythonExec, script string, args []string, stdout scriptStdout) (string, error) {
+	cmd := exec.CommandContext(cmdCtx, pythonExec, append([]string{script}, args...)...)
+	cmd.Dir = scriptWorkDir(script)
+	cmd.Env = scriptEnv()
+
+	var stderrBuf bytes.Buffer
+	cmd.Stdout = stdout
+	// will get nice python panics with this baby, and the EVENT: lines for
+	// /capture/events
+	cmd.Stderr = io.MultiWriter(&stderrBuf, &eventWriter{ctx: ctx})
+
+	err := cmd.Run()
+	if stdout.overLimit() && ctx.Err() == nil {
+		return "", imageTooLarge(ctx, script)
+	}
+	if err != nil && ctx.Err() == nil {
+		if err := pythonMissing(ctx, pythonExec, script, err); err != nil {
+			return "", err
+		}
+	}
+	if err := commandError(ctx, timeout, err, stdout.String(), stderrBuf.String()); err != nil {
+		return "", err
+	}
+
+	if stdout.Len() == 0 {
+		logFor(ctx).Error("python script returned empty output", "event", "capture_empty", "script", script)
+		return "", errEmptyCapture
+	}
+	return stderrBuf.String(), nil
+}
+
+// limitedBuffer is a bytes.Buffer that takes limit bytes at most, the write
+// going over calls exceeded and fails. The buffer isn't embedded, io.Copy
+// would use its ReadFrom and skip the limit
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded func()
+	tooLarge bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.limit {
+		b.tooLarge = true
+		b.exceeded()
+		return 0, errImageTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Len() int        { return b.buf.Len() }
+func (b *limitedBuffer) Bytes() []byte   { return b.buf.Bytes() }
+func (b *limitedBuffer) String() string  { return b.buf.String() }
+func (b *limitedBuffer) overLimit() bool { return b.tooLarge }
+
+// imageTooLarge logs and returns errImageTooLarge for a script that went
+// over maxImageBytes and got killed for it
+func imageTooLarge(ctx context.Context, script string) error {
+	logFor(ctx).Error("capture script wrote more than max-image-bytes, killed it", "event", "capture_too_large", "script", script, "max_image_bytes", maxImageBytes)
+	return fmt.Errorf("%w, more than %d bytes", errImageTooLarge, maxImageBytes)
+}
+
+// retryCapture calls attempt up to captureAttempts times while it fails with
+// a script error, backing off a bit between tries. Timeouts and empty output
+// aren't retried
+func retryCapture(ctx context.Context, attempt func() (bool, error)) error {
+	for n := 1; ; n++ {
+		canRetry, err := attempt()
+		var se *scriptError
+		if err == nil || !canRetry || !errors.As(err, &se) || n >= captureAttempts {
+			return err
+		}
+
+		logFor(ctx).Warn("capture failed, retrying", "event", "capture_retry", "attempt", n, "stderr", se.Stderr)
+		select {
+		case <-time.After(time.Duration(n) * retryBackoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// commandError turns the result of running capture.py into one of our
+// errors and logs it
+func commandError(ctx context.Context, timeout time.Duration, err error, stdout, stderr string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logFor(ctx).Error("capture timed out", "event", "capture_timeout", "timeout", timeout.String())
+		return fmt.Errorf("%w after %s", errCaptureTimeout, timeout)
+	}
+	if ctx.Err() != nil && capturesCtx.Err() == nil {
+		return abortedError(ctx)
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == exitNoFinger {
+		return noFingerError(ctx, stderr)
+	}
+	if err != nil {
+		logFor(ctx).Error("python script failed",
+			"event", "script_failed",
+			"error", err.Error(),
+			"stdout", stdout,
+			"stderr", stderr,
+		)
+		return &scriptError{Err: err, Stderr: stderr}
+	}
+	return nil
+}
+
+// pythonMissing is errPythonMissing when err is from pythonExec or script
+// not being there, nil for any other failure. Like a missing finger it's
+// never retried, it's the setup that's broken
+func pythonMissing(ctx context.Context, pythonExec, script string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		logFor(ctx).Error("python isn't there", "event", "python_missing", "python", pythonExec, "error", err.Error())
+		return fmt.Errorf("%w, can't run %s: %v", errPythonMissing, pythonExec, err)
+	}
+	if _, serr := os.Stat(script); serr != nil {
+		logFor(ctx).Error("capture script isn't there", "event", "python_missing", "script", script, "error", serr.Error())
+		return fmt.Errorf("%w, %v", errPythonMissing, serr)
+	}
+	return nil
+}
+
+// noFingerError logs and returns errNoFinger, it's the user and not the
+// script that failed so it's never retried
+func noFingerError(ctx context.Context, stderr string) error {
+	logFor(ctx).Warn("no finger placed before capture.py gave up", "event", "no_finger", "stderr", stderr)
+	return errNoFinger
+}
+
+// abortedError logs and returns errCaptureAborted for a capture whose
+// request went away
+func abortedError(ctx context.Context) error {
+	logFor(ctx).Warn("capture aborted, the client went away", "event", "capture_aborted")
+	return errCaptureAborted
+}
+
+// captureStatus maps a runCapture error to the status code and message the
+// client gets
+func captureStatus(err error) (int, string) {
+	var se *scriptError
+	switch {
+	case errors.Is(err, errSensorBusy):
+		return http.StatusServiceUnavailable, "Sensor is busy with another capture"
+	case errors.Is(err, errQueueFull):
+		return http.StatusServiceUnavailable, "Too many captures waiting, try again later"
+	case errors.Is(err, errWorkerDown):
+		return http.StatusServiceUnavailable, "Capture worker is down and restarting, try again later"
+	case errors.Is(err, errPythonMissing):
+		return http.StatusServiceUnavailable, "Python or the capture script is missing, the server isn't set up right"
+	case errors.Is(err, errUnknownDevice):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, errCaptureTimeout):
+		return http.StatusGatewayTimeout, "Fingerprint " + err.Error()
+	case errors.Is(err, errCaptureAborted):
+		return statusClientClosedRequest, "Capture aborted"
+	case errors.Is(err, errNoFinger):
+		return http.StatusRequestTimeout, "No finger was placed on the sensor in time, please try again"
+	case errors.Is(err, errSpoofSuspected):
+		return http.StatusForbidden, "Fingerprint looks spoofed, " + strings.TrimPrefix(err.Error(), errSpoofSuspected.Error()+", ")
+	case errors.Is(err, errLivenessUnsupported):
+		return http.StatusNotImplemented, "Liveness detection isn't supported by this sensor"
+	case errors.As(err, &se):
+		return http.StatusInternalServerError, "Failed to capture fingerprint: " + se.Stderr
+	case errors.Is(err, errBadImage):
+		return http.StatusBadGateway, "Failed to capture fingerprint: " + err.Error()
+	case errors.Is(err, errImageTooLarge):
+		return http.StatusBadGateway, "Capture script output is too large: " + err.Error()
+	case errors.Is(err, errEmptyCapture):
+		return http.StatusInternalServerError, "No data received from Python script"
+	case errors.Is(err, errBlankCapture):
+		return http.StatusUnprocessableEntity, "No finger detected, please put a finger on the sensor and scan again"
+	}
+	return http.StatusInternalServerError, "Failed to capture fingerprint: " + err.Error()
+}
@@ -1,6 +1,10 @@
 import os
 import time
 import sys
+import argparse
+import io
+import json
+import struct
 import ctypes
 from ctypes import byref, c_int, c_uint, c_ubyte, c_char_p, c_void_p
 
@@ -11,12 +15,35 @@ TIMEOUT_SECONDS = 30  # Wait up to 30s for a finger
 OUTPUT_BMP = "fingerprint.bmp"  # Output file
 
 
+# in --worker mode what gets logged for the current command, it's sent back
+# with the answer instead of going to stderr
+log_buffer = None
+
+
+# stdout carries the image, everything else goes to stderr
+def log(*args):
+    if log_buffer is not None:
+        log_buffer.append(" ".join(str(a) for a in args))
+        return
+    print(*args, file=sys.stderr)
+
+
+# progress for /capture/events, the server relays these stderr lines as they
+# come. Unlike log they're never buffered, the capture hasn't answered yet
+def event(step: str, message: str):
+    print("EVENT:" + json.dumps({"step": step, "message": message}), file=sys.stderr, flush=True)
+
+
 # ===== Load DLL safely =====
 def load_vendor_dll(name: str) -> ctypes.CDLL:
     try:
+        # next to the script or, when the server runs its embedded copy from
+        # a temp dir, next to the server
         here = os.path.dirname(os.path.abspath(__file__))
-        candidate = os.path.join(here, name)
-        return ctypes.WinDLL(candidate if os.path.isfile(candidate) else name)
+        for candidate in (os.path.join(here, name), os.path.join(os.getcwd(), name)):
+            if os.path.isfile(candidate):
+                return ctypes.WinDLL(candidate)
+        return ctypes.WinDLL(name)
     except OSError as e:
         raise SystemExit(
             f"Failed to load {name}. Make sure 64-bit Python matches a 64-bit DLL "
@@ -32,6 +59,9 @@ DEVICE_USB, DEVICE_COM, DEVICE_UDISK = 0, 1, 2
 PS_OK, PS_COMM_ERR, PS_NO_FINGER = 0x00, 0x01, 0x02
 IMAGE_X, IMAGE_Y = 256, 288
 IMAGE_BYTES = IMAGE_X * IMAGE_Y
+# the sensor always scans at NATIVE_DPI, other --resolution values are resampled
+NATIVE_DPI = 500
+RESOLUTIONS = (250, 500, 1000)
 
 # ===== Function signatures we use (subset) =====
 dll.PSOpenDeviceEx.argtypes = [
@@ -107,10 +137,10 @@ def try_USB_explicit() -> HANDLE:
         rc = dll.PSOpenDeviceEx(byref(h), DEVICE_USB, 1, 1, nPackageSize, 0)
         tried.append((nPackageSize, rc))
         if rc == PS_OK and h:
-            print(f"[USB] Open OK with nPackageSize={nPackageSize}")
+            log(f"[USB] Open OK with nPackageSize={nPackageSize}")
             return h
         else:
-            print(f"[USB] Open failed (nPackageSize={nPackageSize}) → {err_text(rc)}")
+            log(f"[USB] Open failed (nPackageSize={nPackageSize}) → {err_text(rc)}")
     raise RuntimeError(
         "USB open attempts failed: "
         + ", ".join(f"ps={ps}:{err_text(rc)}" for ps, rc in tried)
@@ -127,12 +157,12 @@ def try_COM_scan() -> HANDLE:
             h = HANDLE()
             rc = dll.PSOpenDeviceEx(byref(h), DEVICE_COM, com, ibaud, 2, 0)
             if rc == PS_OK and h:
-                print(f"[COM] Open OK on COM{com} @ {ibaud*9600} bps")
+                log(f"[COM] Open OK on COM{com} @ {ibaud*9600} bps")
                 return h
             else:
                 # Reduce noise—only show likely ports (under 15) or last tried
                 if com <= 15 or (com == 30 and ibaud == 12):
-                    print(f"[COM] COM{com} @ {ibaud*9600} → {err_text(rc)}")
+                    log(f"[COM] COM{com} @ {ibaud*9600} → {err_text(rc)}")
     raise RuntimeError("COM open attempts failed.")
 
 
@@ -144,10 +174,10 @@ def open_device_resilient() -> tuple[HANDLE, str]:
     # Quick visibility: how many USB/UDisk devices the DLL sees
     usb_n = c_int(0)
     if dll.PSGetUSBDevNum(byref(usb_n)) == PS_OK:
-        print(f"DLL reports USB devices: {usb_n.value}")
+        log(f"DLL reports USB devices: {usb_n.value}")
     udisks = c_int(0)
     if dll.PSGetUDiskNum(byref(udisks)) == PS_OK:
-        print(f"DLL reports UDISK devices: {udisks.value}")
+        log(f"DLL reports UDISK devices: {udisks.value}")
 
     # 1) PSAutoOpen (preferred)
     try:
@@ -157,37 +187,127 @@ def open_device_resilient() -> tuple[HANDLE, str]:
             if dtype == DEVICE_USB
             else ("COM" if dtype == DEVICE_COM else f"type={dtype}")
         )
-        print(f"PSAutoOpen succeeded. Mode: {mode}")
+        log(f"PSAutoOpen succeeded. Mode: {mode}")
         return h, mode
     except Exception as e:
-        print(str(e))
+        log(str(e))
 
     # 2) USB explicit with packet-size variants
     try:
         h = try_USB_explicit()
         return h, "USB"
     except Exception as e:
-        print(str(e))
+        log(str(e))
 
     # 3) COM scan
     h = try_COM_scan()
     return h, "COM"
 
 
+def open_device(device: str | None) -> tuple[HANDLE, str]:
+    """
+    Open a specific sensor by id ("usb:<n>" or "com:<port>") or, without an
+    id, whatever open_device_resilient finds first.
+    """
+    if not device:
+        return open_device_resilient()
+
+    kind, _, num = device.partition(":")
+    if not num.isdigit():
+        raise SystemExit(f"Invalid device id {device!r}, want usb:<n> or com:<port>")
+    n = int(num)
+    if kind == "usb":
+        for nPackageSize in (2, 3, 1, 0, 4):
+            h = HANDLE()
+            rc = dll.PSOpenDeviceEx(byref(h), DEVICE_USB, 1, 1, nPackageSize, n)
+            if rc == PS_OK and h:
+                return h, "USB"
+        raise RuntimeError(f"Can't open USB device {n}")
+    if kind == "com":
+        for ibaud in (6, 12):
+            h = HANDLE()
+            rc = dll.PSOpenDeviceEx(byref(h), DEVICE_COM, n, ibaud, 2, 0)
+            if rc == PS_OK and h:
+                return h, "COM"
+        raise RuntimeError(f"Can't open COM{n}")
+    raise SystemExit(f"Invalid device id {device!r}, want usb:<n> or com:<port>")
+
+
+def finger_present(device: str | None) -> dict:
+    """One PSGetImage without waiting or uploading the image, just to see if a finger is down."""
+    h = None
+    try:
+        h, mode = open_device(device)
+        rc = dll.PSGetImage(h, DEFAULT_ADDR)
+        if rc == PS_OK:
+            return {"present": True}
+        if rc == PS_NO_FINGER:
+            return {"present": False}
+        raise RuntimeError(f"PSGetImage failed: {err_text(rc)}")
+    finally:
+        close_device(h)
+
+
+def maintenance(device: str | None, routine: str) -> dict:
+    """
+    Run a maintenance routine, --calibrate or --clean, and answer
+    {"ok": bool, "supported": bool, "message": "..."}. The DLL has no
+    calibration call, so calibrate only says so; a script for a sensor that
+    has one runs it here. clean checks the platen reads empty after a wipe,
+    PSGetImage getting an image without a finger means something's left on it.
+    """
+    if routine == "calibrate":
+        return {"ok": False, "supported": False, "message": "this sensor has no calibration routine"}
+    h = None
+    try:
+        h, mode = open_device(device)
+        rc = dll.PSGetImage(h, DEFAULT_ADDR)
+        if rc == PS_NO_FINGER:
+            return {"ok": True, "supported": True, "message": "platen is clean"}
+        if rc == PS_OK:
+            return {"ok": False, "supported": True, "message": "something is left on the platen, wipe it and try again"}
+        raise RuntimeError(f"PSGetImage failed: {err_text(rc)}")
+    finally:
+        close_device(h)
+
+
+def list_devices() -> dict:
+    """The sensors the DLL can see, for --list. COM ports aren't scanned, that takes ages."""
+    devices = []
+    usb_n = c_int(0)
+    if dll.PSGetUSBDevNum(byref(usb_n)) == PS_OK:
+        devices += [{"id": f"usb:{i}", "type": "usb"} for i in range(usb_n.value)]
+    return {"devices": devices}
+
+
 # ===== Capture helpers =====
-def wait_for_finger_and_capture(h: HANDLE, addr: int, timeout_s: int) -> bytes:
+# exit code when no finger came within the timeout, the server answers 408
+# NO_FINGER for it instead of a 500. Not 2, argparse exits with that on bad
+# arguments. Anything else that goes wrong exits 1
+EXIT_NO_FINGER = 3
+
+
+class NoFingerError(TimeoutError):
+    pass
+
+
+def wait_for_finger_and_capture(h: HANDLE, addr: int, timeout_s: int, events=False) -> bytes:
     t0 = time.time()
+    if events:
+        event("waiting_for_finger", "Place your finger on the sensor")
     while True:
         rc = dll.PSGetImage(h, addr)
         if rc == PS_OK:
             break
         if rc == PS_NO_FINGER:
             if time.time() - t0 > timeout_s:
-                raise TimeoutError("No finger detected within timeout.")
+                raise NoFingerError("No finger detected within timeout.")
             time.sleep(0.15)
             continue
         raise RuntimeError(f"PSGetImage failed: {err_text(rc)}")
 
+    if events:
+        event("finger_detected", "Finger detected, hold still")
     img_buf = (c_ubyte * IMAGE_BYTES)()
     img_len = c_int(IMAGE_BYTES)
     rc = dll.PSUpImage(h, addr, img_buf, byref(img_len))
@@ -203,32 +323,248 @@ def save_bmp_via_dll(img_bytes: bytes, out_path: str):
         raise RuntimeError(f"PSImgData2BMP failed: {err_text(rc)}")
 
 
-# ===== Main =====
-def main():
-    print("Opening fingerprint device …")
+def quality_score(img_bytes: bytes, width=IMAGE_X, height=IMAGE_Y, block=16) -> int:
+    """
+    Rough NFIQ-style 0-100 score: the share of blocks with enough contrast to
+    hold ridges. A bare platen or a smudge scores low.
+    """
+    good = total = 0
+    for by in range(0, height - block + 1, block):
+        for bx in range(0, width - block + 1, block):
+            px = [
+                img_bytes[y * width + x]
+                for y in range(by, by + block)
+                for x in range(bx, bx + block)
+            ]
+            mean = sum(px) / len(px)
+            var = sum((p - mean) ** 2 for p in px) / len(px)
+            total += 1
+            if var > 200:
+                good += 1
+    return round(100 * good / total) if total else 0
+
+
+# image formats the server can ask for, --format value -> Pillow format
+# wsq needs the wsq plugin (pip install wsq) and is 500 dpi only
+FORMATS = {"png": "PNG", "jpeg": "JPEG", "bmp": "BMP", "wsq": "WSQ"}
+
+
+def encode_image(bytes8: bytes, fmt="png", width=IMAGE_X, height=IMAGE_Y, dpi=NATIVE_DPI) -> bytes:
+    from PIL import Image
+
+    if fmt == "wsq":
+        if dpi != NATIVE_DPI:
+            raise ValueError(f"wsq is for {NATIVE_DPI} dpi, not {dpi}")
+        import wsq  # noqa: F401, registers WSQ with Pillow
+
+    out = io.BytesIO()
+    with Image.frombytes("L", (width, height), bytes8) as img:
+        if dpi != NATIVE_DPI:
+            img = img.resize((width * dpi // NATIVE_DPI, height * dpi // NATIVE_DPI), Image.LANCZOS)
+        if fmt == "jpeg":
+            img.save(out, FORMATS[fmt], quality=95)
+        else:
+            img.save(out, FORMATS[fmt])
+    return out.getvalue()
+
+
+def send_image_to_stdout(bytes8: bytes, fmt="png", width=IMAGE_X, height=IMAGE_Y, dpi=NATIVE_DPI):
+    try:
+        sys.stdout.buffer.write(encode_image(bytes8, fmt, width, height, dpi))
+        return
+    except Exception as e:
+        log(f"Pillow save error: {e}")
+        log("⚠️ Pillow save failed;")
+
+
+def write_frame(data: bytes):
+    """Write data to stdout as a 4 byte big endian length followed by the bytes."""
+    sys.stdout.buffer.write(struct.pack(">I", len(data)) + data)
+    sys.stdout.buffer.flush()
+
+
+def preview(h: HANDLE, fmt: str):
+    """
+    Keep capturing and write every frame to stdout with write_frame. Runs
+    until the server kills us.
+    """
+    while True:
+        # no timeout, the user may take a while to put a finger down
+        img = wait_for_finger_and_capture(h, DEFAULT_ADDR, float("inf"))
+        try:
+            write_frame(encode_image(img, fmt))
+        except BrokenPipeError:
+            return
+
+
+def capture(device: str | None, dpi=NATIVE_DPI, liveness=False) -> bytes:
+    """Open the sensor, wait for a finger and return the raw image at NATIVE_DPI."""
+    log("Opening fingerprint device …")
     h = None
     try:
-        h, mode = open_device_resilient()
-        img = wait_for_finger_and_capture(h, DEFAULT_ADDR, TIMEOUT_SECONDS)
-        send_image_to_stdout(img)
-        print("Done.")
+        h, mode = open_device(device)
+        img = wait_for_finger_and_capture(h, DEFAULT_ADDR, TIMEOUT_SECONDS, events=True)
+        event("captured", "Fingerprint captured, you can lift your finger")
+        # the server picks this line out of stderr for X-Fingerprint-Quality
+        log(f"QUALITY={quality_score(img)}")
+        # and this one for X-Image-Resolution
+        log(f"RESOLUTION={dpi}")
+        if liveness:
+            # a sensor that can tell would log LIVENESS=<0-100> here, 100 being
+            # surely a live finger. The DLL can't, so there's no score and the
+            # server goes by -liveness-mode
+            log("Liveness detection isn't supported by this sensor.")
+        return img
     finally:
         close_device(h)
 
 
-if __name__ == "__main__":
-    main()
+def worker():
+    """
+    Serve captures from one long running process so python and the DLL are
+    only loaded once. Every stdin line is a json {"args": [...]} with the usual
+    command line flags. Every answer is a frame with a json header,
+    {"ok": true, "stderr": "..."} followed by a frame with the image, or
+    {"ok": false, "error": "...", "stderr": "..."} on its own, with
+    "noFinger": true when it's what EXIT_NO_FINGER is for.
+    """
+    global log_buffer
+    for line in sys.stdin:
+        if not line.strip():
+            continue
+        log_buffer = []
+        try:
+            args = parse_args(json.loads(line)["args"])
+            if args.list:
+                image = json.dumps(list_devices()).encode()
+            elif args.status:
+                image = json.dumps(sensor_status(args.device)).encode()
+            elif args.finger:
+                image = json.dumps(finger_present(args.device)).encode()
+            elif args.capabilities:
+                image = json.dumps(capabilities()).encode()
+            elif args.calibrate or args.clean:
+                image = json.dumps(maintenance(args.device, "calibrate" if args.calibrate else "clean")).encode()
+            else:
+                image = encode_image(capture(args.device, args.resolution, args.liveness), args.format, dpi=args.resolution)
+            header = {"ok": True}
+        except (Exception, SystemExit) as e:
+            log(f"Capture failed: {e}")
+            image, header = None, {"ok": False, "error": str(e) or type(e).__name__}
+            if isinstance(e, NoFingerError):
+                header["noFinger"] = True
+        header["stderr"] = "\n".join(log_buffer)
+        log_buffer = None
+        write_frame(json.dumps(header).encode())
+        if image is not None:
+            write_frame(image)
+
+
+def parse_args(argv=None):
+    p = argparse.ArgumentParser(description="Capture a fingerprint and write it to stdout")
+    p.add_argument("--format", choices=sorted(FORMATS), default="png")
+    p.add_argument("--preview", action="store_true", help="stream length prefixed frames until killed")
+    p.add_argument("--status", action="store_true", help="write sensor status json to stdout instead of capturing")
+    p.add_argument("--list", action="store_true", help="write the connected sensors as json to stdout")
+    p.add_argument("--finger", action="store_true", help="write whether a finger is on the sensor as json to stdout")
+    p.add_argument("--capabilities", action="store_true", help="write the supported formats, resolutions and image size as json to stdout")
+    p.add_argument("--calibrate", action="store_true", help="run the sensor calibration and write the result as json to stdout")
+    p.add_argument("--clean", action="store_true", help="check the platen is clean and write the result as json to stdout")
+    p.add_argument("--device", help="sensor to use, usb:<n> or com:<port>, default is the first one found")
+    p.add_argument("--resolution", type=int, choices=RESOLUTIONS, default=NATIVE_DPI, help="dpi of the image")
+    p.add_argument("--encode", metavar="IMAGE", help="write IMAGE, a png capture, to stdout in --format instead of capturing")
+    p.add_argument("--liveness", action="store_true", help="check the finger is live and log LIVENESS=<0-100> to stderr")
+    p.add_argument("--worker", action="store_true", help="keep running and serve json capture commands from stdin")
+    return p.parse_args(argv)
+
+
+def sensor_status(device: str | None) -> dict:
+    """Whether a sensor can be opened, never fails because there isn't one."""
+    h = None
+    try:
+        h, mode = open_device(device)
+        # the DLL doesn't tell us the model or firmware, a working open is
+        # all we know
+        out = {"connected": True, "mode": mode}
+    except Exception as e:
+        log(f"No sensor: {e}")
+        out = {"connected": False}
+    finally:
+        close_device(h)
+    return out
 
 
-def send_image_to_stdout(bytes8: bytes, width=256, height=288):
+def capabilities() -> dict:
+    """What this script and the sensor can do, it doesn't open the sensor so it works without one."""
+    formats = ["png", "jpeg", "bmp"]
     try:
-        from PIL import Image
+        import wsq  # noqa: F401
+
+        formats.append("wsq")
+    except ImportError:
+        pass
+    return {
+        "formats": formats,
+        "resolutions": list(RESOLUTIONS),
+        "nativeDpi": NATIVE_DPI,
+        "width": IMAGE_X,
+        "height": IMAGE_Y,
+        # quality_score, there's no liveness detection in the DLL
+        "quality": True,
+        "liveness": False,
+    }
+
+
+def status(device: str | None):
+    json.dump(sensor_status(device), sys.stdout)
 
-        img = Image.frombytes("L", (width, height), bytes8)
-        img.save(sys.stdout.buffer, "PNG", quality=100)
-        img.close()
 
+# ===== Main =====
+def main():
+    args = parse_args()
+    if args.list:
+        json.dump(list_devices(), sys.stdout)
         return
-    except Exception as e:
-        print(f"Pillow save error: {e}")
-        print("⚠️ Pillow save failed;")
+    if args.status:
+        status(args.device)
+        return
+    if args.finger:
+        json.dump(finger_present(args.device), sys.stdout)
+        return
+    if args.capabilities:
+        json.dump(capabilities(), sys.stdout)
+        return
+    if args.calibrate or args.clean:
+        json.dump(maintenance(args.device, "calibrate" if args.calibrate else "clean"), sys.stdout)
+        return
+    if args.encode:
+        # for /capture?bundle=, the server has the png and wants another format
+        from PIL import Image
+
+        with Image.open(args.encode) as img:
+            gray = img.convert("L")
+        sys.stdout.buffer.write(encode_image(gray.tobytes(), args.format, gray.width, gray.height))
+        return
+    if args.worker:
+        worker()
+        return
+    if args.preview:
+        log("Opening fingerprint device …")
+        h = None
+        try:
+            h, mode = open_device(args.device)
+            preview(h, args.format)
+        finally:
+            close_device(h)
+        return
+    try:
+        img = capture(args.device, args.resolution, args.liveness)
+    except NoFingerError as e:
+        log(str(e))
+        sys.exit(EXIT_NO_FINGER)
+    send_image_to_stdout(img, args.format, dpi=args.resolution)
+    log("Done.")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkReport is what -check prints, a line per check
+type checkReport struct {
+	failed int
+}
+
+func (c *checkReport) line(status, name, detail string) {
+	fmt.Printf("%-4s  %-16s %s\n", status, name, detail)
+}
+
+func (c *checkReport) ok(name, detail string) {
+	c.line("ok", name, detail)
+}
+
+func (c *checkReport) warn(name, detail string) {
+	c.line("warn", name, detail)
+}
+
+func (c *checkReport) fail(name string, err error) {
+	c.failed++
+	c.line("FAIL", name, err.Error())
+}
+
+// done prints the verdict and exits, 1 when a check failed
+func (c *checkReport) done() {
+	if c.failed > 0 {
+		fmt.Printf("\n%d check(s) failed\n", c.failed)
+		os.Exit(1)
+	}
+	fmt.Println("\nready to serve")
+	os.Exit(0)
+}
+
+// runCheck is -check. It resolves the config, python and the scripts with
+// what run uses and tries the directories and ports it would, then exits
+// without serving. Startup creates the directories, so does this
+func runCheck(cfg Config, configFile string) {
+	var c checkReport
+	if err := cfg.validate(); err != nil {
+		// the rest depends on it
+		c.fail("config", err)
+		c.done()
+	}
+	cfg.apply()
+	if configFile != "" {
+		c.ok("config", "loaded "+configFile)
+	} else {
+		c.ok("config", "no config file, defaults, env and flags")
+	}
+
+	if err := findAppDir(); err != nil {
+		c.fail("app dir", fmt.Errorf("can't find the server's directory, try -relative-to-cwd: %w", err))
+	} else {
+		dir := appDir
+		if dir == "" {
+			dir, _ = os.Getwd()
+		}
+		c.ok("app dir", dir)
+	}
+	if err := resolveScriptCwd(); err != nil {
+		c.fail("script cwd", err)
+	}
+
+	if mockCapture {
+		c.ok("python", "-mock, capture.py and python aren't used")
+	} else {
+		checkPython(&c, cfg)
+		switch embedded, err := resolveScript(cfg); {
+		case err != nil:
+			c.fail("capture script", err)
+		case embedded:
+			if err := checkWritable(cfg.ScriptDir); err != nil {
+				c.fail("capture script", fmt.Errorf("%s isn't there and the embedded one can't be written: %w", scriptPath, err))
+			} else {
+				c.ok("capture script", fmt.Sprintf("%s isn't there, the embedded one is written to %s", scriptPath, cfg.ScriptDir))
+			}
+		default:
+			c.ok("capture script", scriptPath)
+		}
+	}
+	if err := setupBackends(cfg.Backends); err != nil {
+		c.fail("backends", err)
+	} else if len(backends) > 0 {
+		c.ok("backends", fmt.Sprintf("%d set up", len(backends)))
+	}
+
+	for _, s := range []struct{ name, path, what string }{
+		{"match script", cfg.MatchScript, "/match won't work"},
+		{"template script", cfg.TemplateScript, "/enroll and /verify won't work"},
+	} {
+		path, _ := filepath.Abs(appPath(s.path))
+		if _, err := os.Stat(path); err != nil {
+			c.warn(s.name, fmt.Sprintf("%s not found, %s", path, s.what))
+		} else {
+			c.ok(s.name, path)
+		}
+	}
+
+	for _, d := range []struct{ name, dir string }{
+		{"template dir", cfg.TemplateDir},
+		{"save dir", saveDir},
+		{"log dir", logDir(cfg.LogFile)},
+	} {
+		if d.dir == "" {
+			continue
+		}
+		if err := checkWritable(d.dir); err != nil {
+			c.fail(d.name, err)
+		} else {
+			c.ok(d.name, d.dir+" is writable")
+		}
+	}
+
+	if cfg.Unix != "" {
+		checkListen(&c, "unix", cfg.Unix, func() (net.Listener, error) { return listenUnix(cfg.Unix) })
+	} else {
+		checkListen(&c, "addr", cfg.Addr, func() (net.Listener, error) { return net.Listen("tcp", cfg.Addr) })
+	}
+	if cfg.GRPCAddr != "" {
+		checkListen(&c, "grpc addr", cfg.GRPCAddr, func() (net.Listener, error) { return net.Listen("tcp", cfg.GRPCAddr) })
+	}
+	if cfg.Pprof != "" {
+		checkListen(&c, "pprof", cfg.Pprof, func() (net.Listener, error) { return net.Listen("tcp", cfg.Pprof) })
+	}
+	c.done()
+}
+
+// checkPython resolves -python or the venv like run and runs it
+func checkPython(c *checkReport, cfg Config) {
+	if err := resolvePython(); err != nil {
+		c.fail("python", err)
+		return
+	}
+	switch venv := venvPython(); {
+	case pythonPath != "":
+		c.ok("venv", "not used, -python is set")
+	case fileExists(venv):
+		c.ok("venv", venv)
+	case cfg.Bootstrap:
+		c.warn("venv", venv+" isn't there, -bootstrap creates it on startup")
+	default:
+		c.warn("venv", venv+" isn't there, using "+systemPython()+" from the PATH")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	python := pythonExecutable()
+	if version, err := pythonVersion(ctx, python); err != nil {
+		c.fail("python", err)
+	} else {
+		c.ok("python", version+", "+python)
+	}
+}
+
+// checkListen binds what listen gives and lets go of it right away
+func checkListen(c *checkReport, name, addr string, listen func() (net.Listener, error)) {
+	ln, err := listen()
+	if err != nil {
+		c.fail(name, err)
+		return
+	}
+	ln.Close()
+	c.ok(name, addr+" is free")
+}
+
+// checkWritable creates dir like startup does and writes a file to it
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// logDir is where -log-file goes, "" without one
+func logDir(logFile string) string {
+	if logFile == "" {
+		return ""
+	}
+	return filepath.Dir(logFile)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
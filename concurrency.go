@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// how long a capture waits for a free slot before it gets a 503
+const captureSlotWait = 250 * time.Millisecond
+
+// captureSlots bounds the captures in flight at once, the channel holds one
+// token per running capture. nil is no bound
+var captureSlots chan struct{}
+
+var captureSlotsUsed = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "fingerprint_capture_slots_used",
+	Help: "Captures holding one of the -max-concurrent slots.",
+})
+
+// setupConcurrency bounds the captures in flight to n, 0 is no bound
+func setupConcurrency(n int) {
+	captureSlots = nil
+	if n > 0 {
+		captureSlots = make(chan struct{}, n)
+	}
+}
+
+// maxConcurrent is -max-concurrent, 0 picks what the sensor queue takes so
+// a capture that may wait for the sensor isn't turned away here first:
+// every -worker worker plus -queue-size, or the one running capture plus
+// -max-queue. Without a -max-queue the sensor queue has no bound either
+func (c *Config) maxConcurrent() int {
+	if c.MaxConcurrent > 0 {
+		return c.MaxConcurrent
+	}
+	if c.Worker {
+		workers := c.Workers
+		if devices := c.workerDevices(); len(devices) > 0 {
+			workers = len(devices)
+		}
+		return workers + c.QueueSize
+	}
+	if c.MaxQueue > 0 {
+		return 1 + c.MaxQueue
+	}
+	return 0
+}
+
+// -max-per-client, captures one remote address may have in flight so a
+// single client can't take every slot. 0 is no limit
+var maxPerClient int
+
+// captures in flight per remote address. An address is dropped once it has
+// none, so it only holds the clients that are capturing right now
+var clientCaptures = struct {
+	sync.Mutex
+	m map[string]int
+}{m: map[string]int{}}
+
+// acquireClientSlot counts a capture for addr, ok is false when it has
+// maxPerClient in flight already
+func acquireClientSlot(addr string) (release func(), ok bool) {
+	clientCaptures.Lock()
+	defer clientCaptures.Unlock()
+	if maxPerClient > 0 && clientCaptures.m[addr] >= maxPerClient {
+		return nil, false
+	}
+	clientCaptures.m[addr]++
+	return func() {
+		clientCaptures.Lock()
+		defer clientCaptures.Unlock()
+		if clientCaptures.m[addr]--; clientCaptures.m[addr] <= 0 {
+			delete(clientCaptures.m, addr)
+		}
+	}, true
+}
+
+// concurrencyMiddleWare answers 503 with a Retry-After when -max-concurrent
+// captures are already running, so waiting requests can't pile up. Unlike
+// rateLimitMiddleWare this bounds work in flight, not how often it comes in.
+// A client over its -max-per-client share gets a 429 first
+func concurrencyMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxPerClient > 0 {
+			releaseClient, ok := acquireClientSlot(clientAddr(r))
+			if !ok {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "Too many captures in progress from this client, wait for them to finish", http.StatusTooManyRequests)
+				return
+			}
+			defer releaseClient()
+		}
+		release, ok := acquireCaptureSlot(r.Context())
+		if !ok {
+			if r.Context().Err() != nil {
+				return
+			}
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many captures in progress, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		callback(w, r)
+	}
+}
+
+// acquireCaptureSlot takes a slot, waiting captureSlotWait at most. release
+// gives it back
+func acquireCaptureSlot(ctx context.Context) (release func(), ok bool) {
+	if captureSlots == nil {
+		captureSlotsUsed.Inc()
+		return captureSlotsUsed.Dec, true
+	}
+	t := time.NewTimer(captureSlotWait)
+	defer t.Stop()
+	select {
+	case captureSlots <- struct{}{}:
+	case <-t.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+	captureSlotsUsed.Inc()
+	return func() {
+		<-captureSlots
+		captureSlotsUsed.Dec()
+	}, true
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the server can be configured with. A -config file
+// fills it first, env vars and flags override what the file says. The keys
+// in the file are the flag names
+type Config struct {
+	Addr           string            `yaml:"addr" toml:"addr"`
+	Unix           string            `yaml:"unix" toml:"unix"`
+	UnixLocal      bool              `yaml:"unix-local" toml:"unix-local"`
+	H2C            bool              `yaml:"h2c" toml:"h2c"`
+	GRPCAddr       string            `yaml:"grpc-addr" toml:"grpc-addr"`
+	Pprof          string            `yaml:"pprof" toml:"pprof"`
+	Script         string            `yaml:"script" toml:"script"`
+	Python         string            `yaml:"python" toml:"python"`
+	ScriptDir      string            `yaml:"script-dir" toml:"script-dir"`
+	ScriptArgs     []string          `yaml:"script-args" toml:"script-args"`
+	ScriptCwd      string            `yaml:"script-cwd" toml:"script-cwd"`
+	RelativeToCwd  bool              `yaml:"relative-to-cwd" toml:"relative-to-cwd"`
+	StrictStartup  bool              `yaml:"strict-startup" toml:"strict-startup"`
+	Env            map[string]string `yaml:"env" toml:"env"`
+	Backends       []BackendConfig   `yaml:"backends" toml:"backends"`
+	MatchScript    string            `yaml:"match-script" toml:"match-script"`
+	TemplateScript string            `yaml:"template-script" toml:"template-script"`
+	TemplateDir    string            `yaml:"template-dir" toml:"template-dir"`
+
+	CheckRecentSize      int     `yaml:"check-recent-size" toml:"check-recent-size"`
+	CheckRecentThreshold float64 `yaml:"check-recent-threshold" toml:"check-recent-threshold"`
+
+	Timeout       time.Duration `yaml:"timeout" toml:"timeout"`
+	MaxTimeout    time.Duration `yaml:"max-timeout" toml:"max-timeout"`
+	Busy          string        `yaml:"busy" toml:"busy"`
+	DrainTimeout  time.Duration `yaml:"drain-timeout" toml:"drain-timeout"`
+	Attempts      int           `yaml:"attempts" toml:"attempts"`
+	Bootstrap     bool          `yaml:"bootstrap" toml:"bootstrap"`
+	SelfTest      string        `yaml:"selftest" toml:"selftest"`
+	WaitForSensor time.Duration `yaml:"wait-for-sensor" toml:"wait-for-sensor"`
+	Mock          bool          `yaml:"mock" toml:"mock"`
+	Worker        bool          `yaml:"worker" toml:"worker"`
+	Workers       int           `yaml:"workers" toml:"workers"`
+	WorkerDevices string        `yaml:"worker-devices" toml:"worker-devices"`
+	QueueSize     int           `yaml:"queue-size" toml:"queue-size"`
+	MaxQueue      int           `yaml:"max-queue" toml:"max-queue"`
+
+	WorkerBackoff    time.Duration `yaml:"worker-backoff" toml:"worker-backoff"`
+	WorkerBackoffMax time.Duration `yaml:"worker-backoff-max" toml:"worker-backoff-max"`
+
+	IdleTimeout time.Duration `yaml:"idle-timeout" toml:"idle-timeout"`
+	IdleCommand string        `yaml:"idle-command" toml:"idle-command"`
+	WakeCommand string        `yaml:"wake-command" toml:"wake-command"`
+
+	APIKey         string `yaml:"api-key" toml:"api-key"`
+	BasicAuth      string `yaml:"basic-auth" toml:"basic-auth"`
+	URLSecret      string `yaml:"url-secret" toml:"url-secret"`
+	TLSCert        string `yaml:"tls-cert" toml:"tls-cert"`
+	TLSKey         string `yaml:"tls-key" toml:"tls-key"`
+	AutocertDomain string `yaml:"autocert-domain" toml:"autocert-domain"`
+	AutocertCache  string `yaml:"autocert-cache" toml:"autocert-cache"`
+	CORSOrigin     string `yaml:"cors-origin" toml:"cors-origin"`
+
+	Rate          float64 `yaml:"rate" toml:"rate"`
+	RateBurst     int     `yaml:"rate-burst" toml:"rate-burst"`
+	MaxConcurrent int     `yaml:"max-concurrent" toml:"max-concurrent"`
+	MaxPerClient  int     `yaml:"max-per-client" toml:"max-per-client"`
+
+	SaveDir            string        `yaml:"save-dir" toml:"save-dir"`
+	SaveKeep           int           `yaml:"save-keep" toml:"save-keep"`
+	SaveEncryptKey     string        `yaml:"save-encrypt-key" toml:"save-encrypt-key"`
+	RejectQualityBelow int           `yaml:"reject-quality-below" toml:"reject-quality-below"`
+	CacheTTL           time.Duration `yaml:"cache-ttl" toml:"cache-ttl"`
+	DPI                int           `yaml:"dpi" toml:"dpi"`
+	MaxImageBytes      int           `yaml:"max-image-bytes" toml:"max-image-bytes"`
+	Normalize          bool          `yaml:"normalize" toml:"normalize"`
+	Gamma              float64       `yaml:"gamma" toml:"gamma"`
+	Hash               bool          `yaml:"hash" toml:"hash"`
+	BlankThreshold     float64       `yaml:"blank-threshold" toml:"blank-threshold"`
+
+	LivenessRejectBelow int    `yaml:"liveness-reject-below" toml:"liveness-reject-below"`
+	LivenessMode        string `yaml:"liveness-mode" toml:"liveness-mode"`
+
+	MinQuality     int `yaml:"min-quality" toml:"min-quality"`
+	QualityRetries int `yaml:"quality-retries" toml:"quality-retries"`
+
+	MaxUploadBytes int `yaml:"max-upload-bytes" toml:"max-upload-bytes"`
+
+	TrustProxy bool `yaml:"trust-proxy" toml:"trust-proxy"`
+
+	ReadTimeout     time.Duration `yaml:"read-timeout" toml:"read-timeout"`
+	WriteTimeout    time.Duration `yaml:"write-timeout" toml:"write-timeout"`
+	HTTPIdleTimeout time.Duration `yaml:"http-idle-timeout" toml:"http-idle-timeout"`
+
+	WebhookURL      string        `yaml:"webhook-url" toml:"webhook-url"`
+	WebhookTimeout  time.Duration `yaml:"webhook-timeout" toml:"webhook-timeout"`
+	WebhookAttempts int           `yaml:"webhook-attempts" toml:"webhook-attempts"`
+
+	LogFormat     string `yaml:"log-format" toml:"log-format"`
+	LogFile       string `yaml:"log-file" toml:"log-file"`
+	LogMaxSize    int    `yaml:"log-max-size" toml:"log-max-size"`
+	LogMaxBackups int    `yaml:"log-max-backups" toml:"log-max-backups"`
+	Debug         bool   `yaml:"debug" toml:"debug"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Addr:            defaultAddr,
+		Script:          pythonScript,
+		ScriptDir:       filepath.Join(os.TempDir(), "fingerprint-sensor-server"),
+		MatchScript:     "match.py",
+		TemplateScript:  "template.py",
+		TemplateDir:     "templates",
+		Timeout:         captureTimeout,
+		MaxTimeout:      maxCaptureTimeout,
+		Busy:            busyMode,
+		DrainTimeout:    30 * time.Second,
+		Attempts:        captureAttempts,
+		Workers:         1,
+		QueueSize:       8,
+		DPI:             imageDPI,
+		MaxImageBytes:   maxImageBytes,
+		Gamma:           imageGamma,
+		BlankThreshold:  blankThreshold,
+		AutocertCache:   "autocert-cache",
+		RateBurst:       2,
+		MaxConcurrent:   0,
+		WebhookTimeout:  webhookTimeout,
+		WebhookAttempts: webhookAttempts,
+		LogFormat:       "json",
+		LogMaxSize:      100,
+		LogMaxBackups:   5,
+
+		LivenessMode:     livenessMode,
+		CheckRecentSize:  checkRecentSize,
+		WorkerBackoff:    workerBackoff,
+		WorkerBackoffMax: workerBackoffMax,
+		QualityRetries:   qualityRetries,
+		MaxUploadBytes:   maxUploadBytes,
+
+		ReadTimeout:     time.Minute,
+		HTTPIdleTimeout: 2 * time.Minute,
+	}
+}
+
+// load reads a yaml or toml file, picked by its extension, on top of c.
+// Keys we don't know are an error so a typo doesn't go unnoticed
+func (c *Config) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		// an empty file is fine, it just doesn't change anything
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("unsupported config file %q, want .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// validate catches bad values before anything is started with them
+func (c *Config) validate() error {
+	if err := validBusyMode(c.Busy); err != nil {
+		return err
+	}
+	if err := c.tlsOptions().validate(); err != nil {
+		return err
+	}
+	var err error
+	if c.SelfTest, err = selfTestMode(c.SelfTest); err != nil {
+		return err
+	}
+	switch {
+	case c.Addr == "" && c.Unix == "":
+		return errors.New("addr can't be empty")
+	case c.Unix != "" && c.Addr != defaultAddr:
+		return errors.New("addr and unix can't both be set, the server listens on one or the other")
+	case c.H2C && (c.TLSCert != "" || c.AutocertDomain != ""):
+		return errors.New("h2c is for plain http, with tls the server speaks http2 anyway")
+	case c.Script == "":
+		return errors.New("script can't be empty")
+	case c.Timeout <= 0:
+		return fmt.Errorf("timeout has to be positive, got %s", c.Timeout)
+	case c.Timeout > c.MaxTimeout:
+		return fmt.Errorf("timeout can't be above max-timeout, got %s and %s", c.Timeout, c.MaxTimeout)
+	case c.WaitForSensor < 0:
+		return fmt.Errorf("wait-for-sensor can't be negative, got %s", c.WaitForSensor)
+	case c.DrainTimeout < 0:
+		return fmt.Errorf("drain-timeout can't be negative, got %s", c.DrainTimeout)
+	case c.ReadTimeout < 0:
+		return fmt.Errorf("read-timeout can't be negative, got %s", c.ReadTimeout)
+	case c.WriteTimeout < 0:
+		return fmt.Errorf("write-timeout can't be negative, got %s", c.WriteTimeout)
+	case c.WriteTimeout > 0 && c.WriteTimeout <= c.MaxTimeout:
+		return fmt.Errorf("write-timeout has to be above max-timeout or captures get cut off, got %s and %s", c.WriteTimeout, c.MaxTimeout)
+	case c.HTTPIdleTimeout < 0:
+		return fmt.Errorf("http-idle-timeout can't be negative, got %s", c.HTTPIdleTimeout)
+	case c.Attempts < 1:
+		return fmt.Errorf("attempts has to be at least 1, got %d", c.Attempts)
+	case c.Rate < 0:
+		return fmt.Errorf("rate can't be negative, got %g", c.Rate)
+	case c.Rate > 0 && c.RateBurst < 1:
+		return fmt.Errorf("rate-burst has to be at least 1, got %d", c.RateBurst)
+	case c.MaxConcurrent < 0:
+		return fmt.Errorf("max-concurrent can't be negative, got %d", c.MaxConcurrent)
+	case c.MaxPerClient < 0:
+		return fmt.Errorf("max-per-client can't be negative, got %d", c.MaxPerClient)
+	case c.SaveKeep < 0:
+		return fmt.Errorf("save-keep can't be negative, got %d", c.SaveKeep)
+	case c.RejectQualityBelow < 0 || c.RejectQualityBelow > 100:
+		return fmt.Errorf("reject-quality-below has to be between 0 and 100, got %d", c.RejectQualityBelow)
+	case c.MinQuality < 0 || c.MinQuality > 100:
+		return fmt.Errorf("min-quality has to be between 0 and 100, got %d", c.MinQuality)
+	case c.QualityRetries < 0:
+		return fmt.Errorf("quality-retries can't be negative, got %d", c.QualityRetries)
+	case c.MaxUploadBytes < 1:
+		return fmt.Errorf("max-upload-bytes has to be positive, got %d", c.MaxUploadBytes)
+	case c.LivenessRejectBelow < 0 || c.LivenessRejectBelow > 100:
+		return fmt.Errorf("liveness-reject-below has to be between 0 and 100, got %d", c.LivenessRejectBelow)
+	case c.LivenessMode != livenessLenient && c.LivenessMode != livenessStrict:
+		return fmt.Errorf("liveness-mode has to be lenient or strict, got %q", c.LivenessMode)
+	case c.DPI <= 0:
+		return fmt.Errorf("dpi has to be positive, got %d", c.DPI)
+	case c.MaxImageBytes <= 0:
+		return fmt.Errorf("max-image-bytes has to be positive, got %d", c.MaxImageBytes)
+	case c.BlankThreshold < 0 || c.BlankThreshold > 1:
+		return fmt.Errorf("blank-threshold has to be between 0 and 1, got %g", c.BlankThreshold)
+	case c.Gamma <= 0:
+		return fmt.Errorf("gamma has to be positive, got %g", c.Gamma)
+	case c.CacheTTL < 0:
+		return fmt.Errorf("cache-ttl can't be negative, got %s", c.CacheTTL)
+	case c.WebhookURL != "" && !strings.HasPrefix(c.WebhookURL, "http://") && !strings.HasPrefix(c.WebhookURL, "https://"):
+		return fmt.Errorf("webhook-url has to be an http or https url, got %q", c.WebhookURL)
+	case c.WebhookTimeout <= 0:
+		return fmt.Errorf("webhook-timeout has to be positive, got %s", c.WebhookTimeout)
+	case c.WebhookAttempts < 1:
+		return fmt.Errorf("webhook-attempts has to be at least 1, got %d", c.WebhookAttempts)
+	case c.LogMaxSize < 1:
+		return fmt.Errorf("log-max-size has to be at least 1, got %d", c.LogMaxSize)
+	case c.LogMaxBackups < 0:
+		return fmt.Errorf("log-max-backups can't be negative, got %d", c.LogMaxBackups)
+	case c.Workers < 1:
+		return fmt.Errorf("workers has to be at least 1, got %d", c.Workers)
+	case c.QueueSize < 0:
+		return fmt.Errorf("queue-size can't be negative, got %d", c.QueueSize)
+	case c.WorkerBackoff <= 0:
+		return fmt.Errorf("worker-backoff has to be positive, got %s", c.WorkerBackoff)
+	case c.WorkerBackoffMax < c.WorkerBackoff:
+		return fmt.Errorf("worker-backoff-max can't be below worker-backoff, got %s and %s", c.WorkerBackoffMax, c.WorkerBackoff)
+	case c.IdleTimeout < 0:
+		return fmt.Errorf("idle-timeout can't be negative, got %s", c.IdleTimeout)
+	case c.IdleTimeout == 0 && (c.IdleCommand != "" || c.WakeCommand != ""):
+		return errors.New("idle-command and wake-command need idle-timeout")
+	case c.CheckRecentSize < 1:
+		return fmt.Errorf("check-recent-size has to be at least 1, got %d", c.CheckRecentSize)
+	case c.CheckRecentThreshold < 0:
+		return fmt.Errorf("check-recent-threshold can't be negative, got %g", c.CheckRecentThreshold)
+	case c.MaxQueue < 0:
+		return fmt.Errorf("max-queue can't be negative, got %d", c.MaxQueue)
+	case !c.Worker && (c.Workers > 1 || c.WorkerDevices != ""):
+		return errors.New("workers and worker-devices need worker to be on")
+	}
+	if c.BasicAuth != "" {
+		if _, _, err := parseBasicAuth(c.BasicAuth); err != nil {
+			return fmt.Errorf("basic-auth: %w", err)
+		}
+	}
+	if c.SaveEncryptKey != "" {
+		if _, err := parseEncryptKey(c.SaveEncryptKey); err != nil {
+			return fmt.Errorf("save-encrypt-key: %w", err)
+		}
+	}
+	seen := map[string]bool{}
+	for _, b := range c.Backends {
+		switch {
+		case b.Name == primaryBackend:
+			return fmt.Errorf("backend %q is taken by script", primaryBackend)
+		case !validDeviceID.MatchString(b.Name):
+			return fmt.Errorf("invalid backend name %q", b.Name)
+		case seen[b.Name]:
+			return fmt.Errorf("backend %q is listed twice", b.Name)
+		case b.Script == "":
+			return fmt.Errorf("backend %s has no script", b.Name)
+		}
+		seen[b.Name] = true
+	}
+	for k := range c.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("invalid env var name %q", k)
+		}
+	}
+	devices := c.workerDevices()
+	for _, d := range devices {
+		if !validDeviceID.MatchString(d) {
+			return fmt.Errorf("invalid device id %q in worker-devices", d)
+		}
+	}
+	if len(devices) > 0 && c.Workers > 1 && c.Workers != len(devices) {
+		return fmt.Errorf("workers is %d but worker-devices lists %d devices", c.Workers, len(devices))
+	}
+	return nil
+}
+
+// workerDevices is the worker-devices list, one pool worker per device
+func (c *Config) workerDevices() []string {
+	var devices []string
+	for _, d := range strings.Split(c.WorkerDevices, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+func (c *Config) tlsOptions() tlsOptions {
+	return tlsOptions{
+		certFile:       c.TLSCert,
+		keyFile:        c.TLSKey,
+		autocertDomain: c.AutocertDomain,
+		autocertCache:  c.AutocertCache,
+	}
+}
+
+// apply sets the package level settings the handlers read
+func (c *Config) apply() {
+	captureTimeout = c.Timeout
+	maxCaptureTimeout = c.MaxTimeout
+	extraScriptArgs = c.ScriptArgs
+	scriptCwd = c.ScriptCwd
+	scriptEnvOverrides = c.Env
+	debugMode = c.Debug
+	pythonPath = c.Python
+	mockCapture = c.Mock
+	if mockCapture {
+		capturer = mockCapturer{}
+	}
+	busyMode = c.Busy
+	maxQueue = c.MaxQueue
+	workerBackoff = c.WorkerBackoff
+	checkRecentSize = c.CheckRecentSize
+	relativeToCwd = c.RelativeToCwd
+	idleTimeout = c.IdleTimeout
+	idleCommand = strings.Fields(c.IdleCommand)
+	wakeCommand = strings.Fields(c.WakeCommand)
+	checkRecentThreshold = c.CheckRecentThreshold
+	workerBackoffMax = c.WorkerBackoffMax
+	captureAttempts = c.Attempts
+	apiKey = c.APIKey
+	if c.BasicAuth != "" {
+		basicAuthUser, basicAuthHash, _ = parseBasicAuth(c.BasicAuth)
+	}
+	if c.URLSecret != "" {
+		urlSecret = []byte(c.URLSecret)
+	}
+	corsOrigin = c.CORSOrigin
+	saveDir = c.SaveDir
+	saveKeep = c.SaveKeep
+	if c.SaveEncryptKey != "" {
+		saveKey, _ = parseEncryptKey(c.SaveEncryptKey)
+	}
+	rejectQualityBelow = c.RejectQualityBelow
+	livenessRejectBelow = c.LivenessRejectBelow
+	livenessMode = c.LivenessMode
+	minQuality = c.MinQuality
+	qualityRetries = c.QualityRetries
+	maxUploadBytes = c.MaxUploadBytes
+	trustProxy = c.TrustProxy
+	unixLocal = c.UnixLocal
+	captureCacheTTL = c.CacheTTL
+	imageDPI = c.DPI
+	maxImageBytes = c.MaxImageBytes
+	normalizeImages = c.Normalize
+	imageGamma = c.Gamma
+	hashCaptures = c.Hash
+	blankThreshold = c.BlankThreshold
+	webhookURL = c.WebhookURL
+	webhookTimeout = c.WebhookTimeout
+	webhookAttempts = c.WebhookAttempts
+	setupRateLimit(c.Rate, c.RateBurst)
+	setupConcurrency(c.maxConcurrent())
+	maxPerClient = c.MaxPerClient
+}
+
+// configPath finds -config in args before the flags are parsed, since the
+// file's values are the defaults of every other flag
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("FP_CONFIG")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// origins allowed to call us from a browser, comma separated or *, empty
+// means no CORS headers at all
+var corsOrigin string
+
+func corsMiddleWare(callback func(w http.ResponseWriter, r *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if origin != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, X-API-Key, X-Request-ID, If-None-Match, Cache-Control, X-Requested-With")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Capture-Timestamp, X-Capture-Duration-Ms, X-Queue-Wait-Ms, X-Queue-Length, X-Fingerprint-Quality, X-Image-DPI, X-Image-Resolution, X-Image-Width, X-Image-Height, X-Image-Depth, X-Image-Hash, X-Crop-Box, X-Duplicate-Of, X-Capture-Warnings, X-Cache, X-Capture-Timeout, X-Liveness-Score, X-Capture-Attempts, X-Quality-Warning, ETag, X-Batch-Count, X-Batch-Failed, Retry-After")
+		}
+
+		callback(w, r)
+	}
+}
+
+// allowedOrigin is the Access-Control-Allow-Origin value for a request from
+// origin, empty when it isn't allowed
+func allowedOrigin(origin string) string {
+	if corsOrigin == "" {
+		return ""
+	}
+	if corsOrigin == "*" {
+		return "*"
+	}
+	allowed := strings.Split(corsOrigin, ",")
+	for i := range allowed {
+		allowed[i] = strings.TrimSpace(allowed[i])
+	}
+	if origin != "" && slices.Contains(allowed, origin) {
+		return origin
+	}
+	return ""
+}
+
+// corsOriginHosts is -cors-origin as the host patterns websocket.Accept
+// wants for cross origin upgrades
+func corsOriginHosts() []string {
+	if corsOrigin == "" {
+		return nil
+	}
+	if corsOrigin == "*" {
+		return []string{"*"}
+	}
+	var hosts []string
+	for _, origin := range strings.Split(corsOrigin, ",") {
+		if u, err := url.Parse(strings.TrimSpace(origin)); err == nil && u.Host != "" {
+			hosts = append(hosts, u.Host)
+		}
+	}
+	return hosts
+}
+
+// corsPreflight answers OPTIONS, corsMiddleWare already set the headers
+func corsPreflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,12 @@
+package main
+
+import "encoding/base64"
+
+// ?format=datauri, or Accept: text/uri-list, is the png capture as a data:
+// uri that can go straight into an <img src>
+const dataURIContentType = "text/uri-list"
+
+// dataURI is img as a base64 data: uri of contentType
+func dataURI(img []byte, contentType string) []byte {
+	return []byte("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(img))
+}
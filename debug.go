@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// -debug, log what capture.py said even when it worked and send it back as
+// X-Capture-Warnings
+var debugMode bool
+
+// header values longer than this are cut off
+const maxWarningsHeader = 512
+
+// captureWarnings is what capture.py logged besides the lines the server
+// reads, one line each
+func captureWarnings(stderr string) []string {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "QUALITY=") || strings.HasPrefix(line, "RESOLUTION=") || strings.HasPrefix(line, "LIVENESS=") || strings.HasPrefix(line, eventPrefix) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// debugCapture logs capture.py's output of a successful capture and puts it
+// in X-Capture-Warnings, only with -debug. logIt is false for a capture that
+// was logged already, like a cached one
+func debugCapture(w http.ResponseWriter, r *http.Request, meta Metadata, logIt bool) {
+	lines := debugWarnings(r, meta, logIt)
+	if len(lines) == 0 {
+		return
+	}
+
+	v := strings.Join(lines, "; ")
+	// headers are ascii on one line
+	v = strings.Map(func(c rune) rune {
+		if c < ' ' || c > '~' {
+			return '?'
+		}
+		return c
+	}, v)
+	if len(v) > maxWarningsHeader {
+		v = v[:maxWarningsHeader-3] + "..."
+	}
+	w.Header().Set("X-Capture-Warnings", v)
+}
+
+// debugWarnings is debugCapture without the header, for answers whose
+// headers are out before the capture is done
+func debugWarnings(r *http.Request, meta Metadata, logIt bool) []string {
+	if !debugMode {
+		return nil
+	}
+	lines := captureWarnings(meta.Stderr)
+	if len(lines) > 0 && logIt {
+		logFor(r.Context()).Info("capture script output", "event", "capture_stderr", "stderr", meta.Stderr)
+	}
+	return lines
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// -check-recent-size and -check-recent-threshold. The threshold is the
+// template script's score a duplicate needs, 0 goes by its own match verdict
+var (
+	checkRecentSize      = 5
+	checkRecentThreshold float64
+)
+
+type recentTemplate struct {
+	template   []byte
+	capturedAt time.Time
+}
+
+// templateRing is the templates of the last checkRecentSize captures of
+// /capture/check-recent and /enroll, newest first. It's only ever in memory,
+// a restart forgets it
+type templateRing struct {
+	mu      sync.Mutex
+	entries []recentTemplate
+}
+
+var recentTemplates templateRing
+
+func (t *templateRing) add(tmpl []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = slices.Insert(t.entries, 0, recentTemplate{template: tmpl, capturedAt: time.Now()})
+	if len(t.entries) > checkRecentSize {
+		t.entries = t.entries[:checkRecentSize]
+	}
+}
+
+func (t *templateRing) snapshot() []recentTemplate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.entries)
+}
+
+func isDuplicate(res matchResult) bool {
+	if checkRecentThreshold > 0 {
+		return res.Score >= checkRecentThreshold
+	}
+	return res.Match
+}
+
+// HandleCheckRecent captures a print and compares it with the last few
+// captures, so a person enrolled twice back to back gets caught. It's not a
+// verify, nothing enrolled is looked at. index is 0 for the newest one
+func HandleCheckRecent(w http.ResponseWriter, r *http.Request) {
+	tmpl, ok := captureTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	prev := recentTemplates.snapshot()
+	best := -1
+	var bestRes matchResult
+	for i, p := range prev {
+		res, err := compareTemplates(r.Context(), p.template, tmpl)
+		if err != nil {
+			logError(r, err)
+			writeScriptError(w, "Template compare", err)
+			return
+		}
+		if best < 0 || res.Score > bestRes.Score {
+			best, bestRes = i, res
+		}
+	}
+	recentTemplates.add(tmpl)
+
+	resp := map[string]any{"duplicate": false, "compared": len(prev)}
+	if best >= 0 {
+		resp["duplicate"] = isDuplicate(bestRes)
+		resp["index"] = best
+		resp["score"] = bestRes.Score
+		resp["capturedAt"] = prev[best].capturedAt.UTC()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// resolution the images are tagged with, fingerprint sensors scan at 500
+var imageDPI = 500
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// requestDPI is imageDPI unless ?dpi= overrides it
+func requestDPI(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("dpi")
+	if v == "" {
+		return imageDPI, nil
+	}
+	dpi, err := strconv.Atoi(v)
+	if err != nil || dpi <= 0 || dpi > 100000 {
+		return 0, fmt.Errorf("invalid dpi %q", v)
+	}
+	return dpi, nil
+}
+
+// what ?resolution= can ask capture.py for
+var resolutions = []int{250, 500, 1000}
+
+// requestResolution is ?resolution=, 0 when it isn't set and capture.py
+// scans at its default
+func requestResolution(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("resolution")
+	if v == "" {
+		return 0, nil
+	}
+	dpi, err := strconv.Atoi(v)
+	if err != nil || !slices.Contains(resolutions, dpi) {
+		return 0, fmt.Errorf("unsupported resolution %q, want 250, 500 or 1000", v)
+	}
+	return dpi, nil
+}
+
+// setPNGDPI puts a pHYs chunk with dpi right after IHDR, replacing any pHYs
+// capture.py wrote, so matchers know the scan resolution
+func setPNGDPI(img []byte, dpi int) ([]byte, error) {
+	if !bytes.HasPrefix(img, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(img)+21))
+	out.Write(pngSignature)
+	rest := img[len(pngSignature):]
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, errors.New("truncated png chunk")
+		}
+		size := binary.BigEndian.Uint32(rest)
+		if uint64(size)+12 > uint64(len(rest)) {
+			return nil, errors.New("truncated png chunk")
+		}
+		chunk := rest[:size+12]
+		rest = rest[size+12:]
+
+		switch string(chunk[4:8]) {
+		case "pHYs":
+			continue
+		case "IHDR":
+			out.Write(chunk)
+			writePHYs(out, dpi)
+			continue
+		}
+		out.Write(chunk)
+	}
+	return out.Bytes(), nil
+}
+
+func writePHYs(w *bytes.Buffer, dpi int) {
+	// pixels per metre, unit 1 says it's metres
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+	data := make([]byte, 0, 13)
+	data = append(data, "pHYs"...)
+	data = binary.BigEndian.AppendUint32(data, ppm)
+	data = binary.BigEndian.AppendUint32(data, ppm)
+	data = append(data, 1)
+
+	binary.Write(w, binary.BigEndian, uint32(9))
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(data))
+}
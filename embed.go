@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"os"
+	"path/filepath"
+)
+
+// the capture.py this binary was built with, used when there's none on disk
+//
+//go:embed capture.py
+var embeddedCaptureScript []byte
+
+// extractCaptureScript writes the embedded capture.py into dir, unless an
+// identical copy is already there, and returns its path
+func extractCaptureScript(dir string) (string, error) {
+	path, err := filepath.Abs(filepath.Join(dir, pythonScript))
+	if err != nil {
+		return "", err
+	}
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, embeddedCaptureScript) {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// written next to it and renamed so a crash never leaves half a script
+	tmp, err := os.CreateTemp(dir, pythonScript+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(embeddedCaptureScript); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
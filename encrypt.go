@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// saved captures encrypted with -save-encrypt-key get this on top of their
+// name, <stamp>.png.enc
+const encryptedExt = ".enc"
+
+// -save-encrypt-key, the AES-GCM key saved captures are encrypted with. nil
+// saves them in the clear
+var saveKey []byte
+
+// parseEncryptKey reads -save-encrypt-key, 32, 48 or 64 hex digits for
+// AES-128, -192 or -256
+func parseEncryptKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("want hex, make one with openssl rand -hex 32")
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("want 32, 48 or 64 hex digits, got %d", len(s))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptCapture is img sealed with key, the random nonce goes in front of
+// it
+func encryptCapture(key, img []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, img, nil), nil
+}
+
+// decryptCapture undoes encryptCapture
+func decryptCapture(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("too short to be an encrypted capture")
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	img, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("wrong key or the file was changed")
+	}
+	return img, nil
+}
+
+// decryptFile is -decrypt, it writes the capture in path to stdout
+func decryptFile(keyHex, path string) error {
+	if keyHex == "" {
+		return errors.New("-decrypt needs -save-encrypt-key")
+	}
+	key, err := parseEncryptKey(keyHex)
+	if err != nil {
+		return fmt.Errorf("save-encrypt-key: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	img, err := decryptCapture(key, data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	_, err = os.Stdout.Write(img)
+	return err
+}
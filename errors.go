@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// error codes of the /capture json errors, clients branch on these so they
+// don't change
+const (
+	codeBadRequest     = "BAD_REQUEST"
+	codeForbidden      = "FORBIDDEN"
+	codeNotAcceptable  = "NOT_ACCEPTABLE"
+	codeSensorBusy     = "SENSOR_BUSY"
+	codeQueueFull      = "QUEUE_FULL"
+	codeWorkerDown     = "WORKER_DOWN"
+	codePythonMissing  = "PYTHON_MISSING"
+	codeSpoofSuspected = "SPOOF_SUSPECTED"
+	codeNoLiveness     = "LIVENESS_UNSUPPORTED"
+	codeUnknownDevice  = "UNKNOWN_DEVICE"
+	codeCaptureTimeout = "CAPTURE_TIMEOUT"
+	codeCaptureAborted = "CAPTURE_ABORTED"
+	codeCaptureFailed  = "CAPTURE_FAILED"
+	codeBadImage       = "BAD_IMAGE"
+	codeImageTooLarge  = "IMAGE_TOO_LARGE"
+	codeEmptyCapture   = "EMPTY_CAPTURE"
+	codeLowQuality     = "LOW_QUALITY"
+	codeNoFinger       = "NO_FINGER"
+	codeCropOutside    = "CROP_OUTSIDE"
+	codeInternal       = "INTERNAL"
+)
+
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+	// what capture.py logged before it failed, only with -debug
+	Stderr string `json:"stderr,omitempty"`
+}
+
+type apiErrorBody struct {
+	Error apiError `json:"error"`
+}
+
+// writeAPIError answers with the {"error": {...}} envelope
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	writeJSON(w, status, apiErrorBody{apiError{Code: code, Message: msg, RequestID: requestID(r.Context())}})
+}
+
+// writeCaptureError is writeAPIError for a failed capture. The python
+// traceback stays in the log unless -debug is on
+func writeCaptureError(w http.ResponseWriter, r *http.Request, err error) {
+	status, _ := captureStatus(err)
+	var qf *queueFullError
+	if errors.As(err, &qf) {
+		w.Header().Set("X-Queue-Length", strconv.Itoa(qf.length))
+	}
+	var spoof *spoofError
+	if errors.As(err, &spoof) {
+		w.Header().Set("X-Liveness-Score", strconv.Itoa(spoof.score))
+	}
+	var wd *workerDownError
+	if errors.As(err, &wd) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wd.retryIn.Seconds()))))
+	}
+	writeJSON(w, status, apiErrorBody{captureAPIError(r, err)})
+}
+
+// captureAPIError is what a client is told about a failed capture
+func captureAPIError(r *http.Request, err error) apiError {
+	_, msg := captureStatus(err)
+	e := apiError{Code: captureCode(err), Message: msg, RequestID: requestID(r.Context())}
+	var se *scriptError
+	if errors.As(err, &se) {
+		e.Message = "Failed to capture fingerprint, the capture script exited with an error"
+		if debugMode {
+			e.Stderr = se.Stderr
+		}
+	}
+	return e
+}
+
+// captureCode is the error code for a runCapture error, in the order
+// captureStatus checks them
+func captureCode(err error) string {
+	var se *scriptError
+	switch {
+	case errors.Is(err, errSensorBusy):
+		return codeSensorBusy
+	case errors.Is(err, errQueueFull):
+		return codeQueueFull
+	case errors.Is(err, errWorkerDown):
+		return codeWorkerDown
+	case errors.Is(err, errPythonMissing):
+		return codePythonMissing
+	case errors.Is(err, errUnknownDevice):
+		return codeUnknownDevice
+	case errors.Is(err, errCaptureTimeout):
+		return codeCaptureTimeout
+	case errors.Is(err, errCaptureAborted):
+		return codeCaptureAborted
+	case errors.Is(err, errNoFinger):
+		return codeNoFinger
+	case errors.Is(err, errSpoofSuspected):
+		return codeSpoofSuspected
+	case errors.Is(err, errLivenessUnsupported):
+		return codeNoLiveness
+	case errors.As(err, &se):
+		return codeCaptureFailed
+	case errors.Is(err, errBadImage):
+		return codeBadImage
+	case errors.Is(err, errImageTooLarge):
+		return codeImageTooLarge
+	case errors.Is(err, errEmptyCapture):
+		return codeEmptyCapture
+	case errors.Is(err, errBlankCapture):
+		return codeNoFinger
+	}
+	return codeCaptureFailed
+}
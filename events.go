@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// capture.py reports progress on stderr lines starting with this, like
+// EVENT:{"step":"waiting_for_finger","message":"Place your finger on the sensor"}.
+// What follows is relayed to /capture/events as is
+const eventPrefix = "EVENT:"
+
+type captureEventsKey struct{}
+
+// withCaptureEvents has the progress capture.py reports under ctx passed to
+// fn, it's called from the goroutine reading the script's stderr
+func withCaptureEvents(ctx context.Context, fn func(event string)) context.Context {
+	return context.WithValue(ctx, captureEventsKey{}, fn)
+}
+
+// captureEvent passes event on to whoever is listening under ctx
+func captureEvent(ctx context.Context, event string) {
+	if ctx == nil {
+		return
+	}
+	if fn, ok := ctx.Value(captureEventsKey{}).(func(string)); ok {
+		fn(event)
+	}
+}
+
+// eventWriter picks the EVENT: lines out of a script's stderr and relays
+// them to ctx. Every other line goes on to next when there is one
+type eventWriter struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	next    io.Writer
+	partial []byte
+}
+
+// listen relays the events to ctx from now on, nil stops relaying. The worker
+// sets it for every capture
+func (e *eventWriter) listen(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ctx = ctx
+}
+
+func (e *eventWriter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.partial = append(e.partial, p...)
+	for {
+		line, rest, found := bytes.Cut(e.partial, []byte("\n"))
+		if !found {
+			break
+		}
+		if event, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte(eventPrefix)); ok {
+			captureEvent(e.ctx, string(bytes.TrimSpace(event)))
+		} else if e.next != nil {
+			e.next.Write(e.partial[:len(line)+1])
+		}
+		e.partial = rest
+	}
+	return len(p), nil
+}
+
+// sseWriter writes server-sent events, the capture goroutine and the handler
+// both write to it
+type sseWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (s *sseWriter) send(event string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "event: %s\n", event)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(s.w, "data: %s\n", line)
+	}
+	fmt.Fprint(s.w, "\n")
+	s.rc.Flush()
+}
+
+func (s *sseWriter) sendJSON(event string, v any) {
+	data, _ := json.Marshal(v)
+	s.send(event, data)
+}
+
+// HandleCaptureEvents is HandleCaptureJSON as a server-sent event stream. A
+// progress event is sent for every step capture.py reports, then one capture
+// event with the same json as /capture.json or an error event with the code
+// and message /capture would have answered. The stream ends after either, a
+// client going away aborts the capture like for /capture
+func HandleCaptureEvents(w http.ResponseWriter, r *http.Request) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	device, err := requestDevice(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	liveness, err := requestLiveness(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// nginx buffers the stream otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("X-Capture-Timeout", timeout.String())
+	w.WriteHeader(http.StatusOK)
+	sse := &sseWriter{w: w, rc: http.NewResponseController(w)}
+	sse.rc.Flush()
+
+	ctx := withCaptureEvents(r.Context(), func(event string) {
+		sse.send("progress", []byte(event))
+	})
+	done := trackCapture()
+	img, meta, _, err := captureBest(ctx, CaptureOptions{Device: device, Timeout: timeout, Liveness: liveness})
+	done(err)
+	if err != nil {
+		logError(r, err)
+		if r.Context().Err() != nil {
+			return
+		}
+		sse.sendJSON("error", captureAPIError(r, err))
+		return
+	}
+	if meta.Quality != nil {
+		if quality := *meta.Quality; quality < rejectQualityBelow {
+			logError(r, fmt.Errorf("quality %d is below %d", quality, rejectQualityBelow))
+			sse.sendJSON("error", apiError{Code: codeLowQuality, Message: fmt.Sprintf("Fingerprint quality %d is below %d, please scan again", quality, rejectQualityBelow), RequestID: requestID(r.Context())})
+			return
+		}
+	}
+
+	// the headers are long gone, -debug's warnings get an event of their own
+	if lines := debugWarnings(r, meta, true); len(lines) > 0 {
+		sse.sendJSON("warnings", lines)
+	}
+	saveCapture(r.Context(), img, meta.CapturedAt, "png")
+	width, height, _ := imageSize(img)
+	sse.sendJSON("capture", captureJSON{
+		Format:      "png",
+		Width:       width,
+		Height:      height,
+		CapturedAt:  meta.CapturedAt.UTC(),
+		Quality:     meta.Quality,
+		Liveness:    meta.Liveness,
+		ImageBase64: base64.StdEncoding.EncodeToString(img),
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how long a ?dest=file capture stays around, it's deleted after
+const captureFileTTL = 5 * time.Minute
+
+// captureFile is a ?dest=file capture waiting to be picked up
+type captureFile struct {
+	path        string
+	contentType string
+	expires     time.Time
+}
+
+var (
+	captureFilesMu sync.Mutex
+	captureFiles   = map[string]captureFile{}
+	// made on the first ?dest=file capture
+	captureFileDir string
+)
+
+type captureFileJSON struct {
+	Path        string    `json:"path"`
+	Token       string    `json:"token"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+}
+
+// -unix-local, unix socket clients count as local. Off by default, a proxy
+// in front of the socket makes everyone a unix peer
+var unixLocal bool
+
+// localRequest is whether r came from this machine, over loopback or with
+// -unix-local the unix socket. A request a proxy forwarded isn't, unless
+// -trust-proxy says who the client is and that's loopback
+func localRequest(r *http.Request) bool {
+	if r.Header.Get("Forwarded") != "" {
+		// nothing reads it, so there's no telling who sent it
+		return false
+	}
+	if len(r.Header.Values("X-Forwarded-For")) > 0 {
+		if !trustProxy {
+			return false
+		}
+	} else if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return unixLocal
+	}
+	ip := net.ParseIP(clientAddr(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeCaptureFile puts body in a temp file only the server's user can read
+// and answers with its path and the token for /file/{token}
+func writeCaptureFile(w http.ResponseWriter, r *http.Request, body []byte, contentType, ext string) {
+	token, path, err := storeCaptureFile(body, contentType, ext)
+	if err != nil {
+		logError(r, err)
+		writeAPIError(w, r, http.StatusInternalServerError, codeInternal, "can't write the capture file")
+		return
+	}
+	writeJSON(w, http.StatusOK, captureFileJSON{
+		Path:        path,
+		Token:       token,
+		ExpiresAt:   time.Now().Add(captureFileTTL).UTC(),
+		ContentType: contentType,
+		Size:        len(body),
+	})
+}
+
+func storeCaptureFile(body []byte, contentType, ext string) (token, path string, err error) {
+	captureFilesMu.Lock()
+	defer captureFilesMu.Unlock()
+
+	if captureFileDir == "" {
+		if captureFileDir, err = os.MkdirTemp("", "fingerprint-captures-"); err != nil {
+			return "", "", err
+		}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+	path = filepath.Join(captureFileDir, token+"."+ext)
+	if err := os.WriteFile(path, body, 0o600); err != nil {
+		return "", "", err
+	}
+	captureFiles[token] = captureFile{path: path, contentType: contentType, expires: time.Now().Add(captureFileTTL)}
+	time.AfterFunc(captureFileTTL, func() { removeCaptureFile(token) })
+	return token, path, nil
+}
+
+// removeCaptureFile deletes the file of token, false if it was already gone
+func removeCaptureFile(token string) bool {
+	captureFilesMu.Lock()
+	f, ok := captureFiles[token]
+	delete(captureFiles, token)
+	captureFilesMu.Unlock()
+	if !ok {
+		return false
+	}
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("can't remove capture file", "path", f.path, "error", err.Error())
+	}
+	return true
+}
+
+// removeCaptureFiles cleans up on shutdown
+func removeCaptureFiles() {
+	captureFilesMu.Lock()
+	defer captureFilesMu.Unlock()
+	if captureFileDir != "" {
+		os.RemoveAll(captureFileDir)
+	}
+}
+
+func lookupCaptureFile(token string) (captureFile, bool) {
+	captureFilesMu.Lock()
+	defer captureFilesMu.Unlock()
+	f, ok := captureFiles[token]
+	if !ok || time.Now().After(f.expires) {
+		return captureFile{}, false
+	}
+	return f, true
+}
+
+// HandleCaptureFile sends a ?dest=file capture, for clients that would
+// rather not read it off the disk
+func HandleCaptureFile(w http.ResponseWriter, r *http.Request) {
+	if !localRequest(r) {
+		writeJSONError(w, http.StatusForbidden, "capture files are only for clients on this machine")
+		return
+	}
+	f, ok := lookupCaptureFile(r.PathValue("token"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such capture file, it may have expired")
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	http.ServeFile(w, r, f.path)
+}
+
+// HandleDeleteCaptureFile removes a ?dest=file capture before it expires
+func HandleDeleteCaptureFile(w http.ResponseWriter, r *http.Request) {
+	if !localRequest(r) {
+		writeJSONError(w, http.StatusForbidden, "capture files are only for clients on this machine")
+		return
+	}
+	if !removeCaptureFile(r.PathValue("token")) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no capture file %q", r.PathValue("token")))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,264 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative sensorpb/sensor.proto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"sensor/sensorpb"
+)
+
+// grpcSensor serves sensorpb.Sensor with the same capture path as the http
+// handlers, so both share the sensor lock, the workers and every setting
+type grpcSensor struct {
+	sensorpb.UnimplementedSensorServer
+}
+
+// newGRPCServer is the -grpc-addr server, with the api key and request
+// logging of the http side. It uses -tls-cert when set, autocert is http only
+func newGRPCServer(o tlsOptions) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcLogUnary, grpcAuthUnary),
+		grpc.ChainStreamInterceptor(grpcLogStream, grpcAuthStream),
+	}
+	if o.certFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := grpc.NewServer(opts...)
+	sensorpb.RegisterSensorServer(s, grpcSensor{})
+	return s, nil
+}
+
+// serveGRPC runs s on addr until it's stopped
+func serveGRPC(s *grpc.Server, addr string, tls bool) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("can't listen for grpc", "addr", addr, "error", err.Error())
+	}
+	slog.Info("starting grpc server", "addr", ln.Addr().String(), "tls", tls)
+	if err := s.Serve(ln); err != nil {
+		fatal("grpc server stopped", "error", err.Error())
+	}
+}
+
+func (grpcSensor) Capture(ctx context.Context, req *sensorpb.CaptureRequest) (*sensorpb.CaptureResponse, error) {
+	format := req.Format
+	if format == "" {
+		format = "png"
+	}
+	if _, ok := formats[format]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported format %q, want png, jpeg, bmp or wsq", format)
+	}
+	if req.Device != "" && !validDeviceID.MatchString(req.Device) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid device id %q", req.Device)
+	}
+	opts := CaptureOptions{
+		Format:  format,
+		Device:  req.Device,
+		Timeout: min(time.Duration(req.TimeoutMs)*time.Millisecond, maxCaptureTimeout),
+	}
+
+	if draining.Load() {
+		return nil, status.Error(codes.Unavailable, drainingMessage)
+	}
+	if waitingForSensor.Load() {
+		return nil, status.Error(codes.Unavailable, waitingForSensorMessage)
+	}
+	if captureLimiter != nil && !captureLimiter.Allow() {
+		return nil, status.Error(codes.ResourceExhausted, "Too many captures, slow down")
+	}
+	release, ok := acquireCaptureSlot(ctx)
+	if !ok {
+		return nil, status.Error(codes.ResourceExhausted, "Too many captures in progress, try again later")
+	}
+	defer release()
+
+	done := trackCapture()
+	img, meta, err := capturer.Capture(ctx, opts)
+	done(err)
+	if err != nil {
+		return nil, grpcCaptureError(err)
+	}
+	resp := &sensorpb.CaptureResponse{
+		Image:       img,
+		Format:      format,
+		ContentType: meta.ContentType,
+		Dpi:         int32(formatDPI(format)),
+		CapturedAt:  timestamppb.New(meta.CapturedAt),
+	}
+	if meta.Quality != nil {
+		q := *meta.Quality
+		q32 := int32(q)
+		resp.Quality = &q32
+		if q < rejectQualityBelow {
+			return nil, status.Errorf(codes.FailedPrecondition, "Fingerprint quality %d is below %d, please scan again", q, rejectQualityBelow)
+		}
+	}
+	saveCapture(ctx, img, meta.CapturedAt, format)
+	return resp, nil
+}
+
+func (grpcSensor) Preview(req *sensorpb.PreviewRequest, stream grpc.ServerStreamingServer[sensorpb.PreviewFrame]) error {
+	format := req.Format
+	if format == "" {
+		format = "png"
+	}
+	contentType, ok := formats[format]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "unsupported format %q, want png, jpeg, bmp or wsq", format)
+	}
+	if draining.Load() {
+		return status.Error(codes.Unavailable, drainingMessage)
+	}
+	if waitingForSensor.Load() {
+		return status.Error(codes.Unavailable, waitingForSensorMessage)
+	}
+	err := runPreview(stream.Context(), format, func(frame []byte) error {
+		return stream.Send(&sensorpb.PreviewFrame{Image: frame, ContentType: contentType})
+	})
+	if err != nil {
+		return grpcCaptureError(err)
+	}
+	return nil
+}
+
+// grpcCaptureError is captureStatus for grpc
+func grpcCaptureError(err error) error {
+	_, msg := captureStatus(err)
+	code := codes.Internal
+	switch {
+	case errors.Is(err, errSensorBusy):
+		code = codes.Unavailable
+	case errors.Is(err, errQueueFull):
+		code = codes.ResourceExhausted
+	case errors.Is(err, errWorkerDown), errors.Is(err, errPythonMissing):
+		code = codes.Unavailable
+	case errors.Is(err, errUnknownDevice):
+		code = codes.InvalidArgument
+	case errors.Is(err, errCaptureTimeout):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, errCaptureAborted):
+		code = codes.Canceled
+	case errors.Is(err, errBlankCapture), errors.Is(err, errNoFinger):
+		code = codes.FailedPrecondition
+	case errors.Is(err, errSpoofSuspected):
+		code = codes.PermissionDenied
+	case errors.Is(err, errLivenessUnsupported):
+		code = codes.Unimplemented
+	}
+	return status.Error(code, msg)
+}
+
+// grpcAuth is authMiddleWare for grpc, the key comes as x-api-key or
+// authorization: Bearer metadata, basic auth as authorization: Basic
+func grpcAuth(ctx context.Context) error {
+	if !authRequired() {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var key, authorization string
+	if v := md.Get("x-api-key"); len(v) > 0 {
+		key = v[0]
+	}
+	if v := md.Get("authorization"); len(v) > 0 {
+		authorization = v[0]
+		if bearer, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+			key = bearer
+		}
+	}
+	if checkAPIKey(key) {
+		return nil
+	}
+	// net/http already knows how to take basic auth apart
+	r := &http.Request{Header: http.Header{"Authorization": {authorization}}}
+	if validBasicAuth(r) {
+		return nil
+	}
+	return status.Error(codes.Unauthenticated, "Missing or invalid credentials")
+}
+
+func grpcAuthUnary(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := grpcAuth(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcAuthStream(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := grpcAuth(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// grpcLogContext is logRequest for grpc, it takes x-request-id metadata or
+// makes up an id and sends it back as a header
+func grpcLogContext(ctx context.Context) (context.Context, *logInfo) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var id string
+	if v := md.Get("x-request-id"); len(v) > 0 {
+		id = v[0]
+	}
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	info := &logInfo{id: id, logger: slog.Default().With("request_id", id)}
+	return context.WithValue(ctx, logInfoKey{}, info), info
+}
+
+func grpcLogLine(info *logInfo, method string, now time.Time, err error) {
+	attrs := []any{
+		"event", "grpc",
+		"method", method,
+		"duration_ms", time.Since(now).Milliseconds(),
+		"code", status.Code(err).String(),
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	info.logger.Info("grpc call done", attrs...)
+}
+
+func grpcLogUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	now := time.Now()
+	ctx, li := grpcLogContext(ctx)
+	resp, err := handler(ctx, req)
+	grpcLogLine(li, info.FullMethod, now, err)
+	return resp, err
+}
+
+// loggedStream swaps in the context with the request logger
+type loggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *loggedStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcLogStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	now := time.Now()
+	ctx, li := grpcLogContext(ss.Context())
+	err := handler(srv, &loggedStream{ServerStream: ss, ctx: ctx})
+	grpcLogLine(li, info.FullMethod, now, err)
+	return err
+}
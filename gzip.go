@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// content types worth compressing, pngs and jpegs already are
+func compressible(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "text/event-stream":
+		// every event has to go out when it's sent
+		return false
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case mt == "application/json", mt == "application/octet-stream", mt == "image/bmp":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip is whether the Accept-Encoding header allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipWriter decides on the first write whether the response gets gzipped,
+// by then the handler has set the content type
+type gzipWriter struct {
+	http.ResponseWriter
+	accepts bool
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipWriter) decide(status int) {
+	g.decided = true
+	h := g.Header()
+	if status == http.StatusNoContent || h.Get("Content-Encoding") != "" {
+		return
+	}
+	if !compressible(h.Get("Content-Type")) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if !g.accepts {
+		return
+	}
+	// a strong ETag is for the bytes as the handler wrote them. A 304 has no
+	// body but gets the ETag the gzipped 200 would have
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	if status == http.StatusNotModified {
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if !g.decided {
+		g.decide(status)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// Flush sends what gzip holds back too, a ResponseController calls it rather
+// than going straight to the ResponseWriter underneath
+func (g *gzipWriter) Flush() {
+	if !g.decided {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// gzipMiddleWare gzips json and other uncompressed responses for clients that
+// take it. Websocket upgrades are left alone, they need the raw connection
+func gzipMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			callback(w, r)
+			return
+		}
+		g := &gzipWriter{ResponseWriter: w, accepts: acceptsGzip(r)}
+		defer func() {
+			if g.gz != nil {
+				g.gz.Close()
+			}
+		}()
+		callback(g, r)
+	}
+}
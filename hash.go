@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+)
+
+// -hash, send X-Image-Hash with every capture and flag repeats
+var hashCaptures bool
+
+// imageHash identifies a capture by its pixels, so the same print in png
+// and bmp hashes the same
+type imageHash struct {
+	// sha256 of the 8 bit gray pixels
+	sum string
+	// difference hash, equal for a finger that didn't move between scans
+	dhash uint64
+}
+
+// hashImage decodes img and hashes its pixels
+func hashImage(img []byte) (imageHash, error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return imageHash{}, fmt.Errorf("can't decode capture: %w", err)
+	}
+	b := src.Bounds()
+	h := sha256.New()
+	row := make([]byte, b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			row[x-b.Min.X] = color.GrayModel.Convert(src.At(x, y)).(color.Gray).Y
+		}
+		h.Write(row)
+	}
+	return imageHash{sum: hex.EncodeToString(h.Sum(nil)), dhash: dHash(src)}, nil
+}
+
+// dHash shrinks src to 9x8 and sets a bit for every cell brighter than its
+// right neighbour
+func dHash(src image.Image) uint64 {
+	b := src.Bounds()
+	var cells [8][9]uint64
+	var counts [8][9]uint64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * 8 / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * 9 / b.Dx()
+			cells[cy][cx] += uint64(color.GrayModel.Convert(src.At(x, y)).(color.Gray).Y)
+			counts[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := range 8 {
+		for x := range 8 {
+			// compare averages, cells can differ in size by a pixel
+			if cells[y][x]*counts[y][x+1] > cells[y][x+1]*counts[y][x] {
+				hash |= 1 << (y*8 + x)
+			}
+		}
+	}
+	return hash
+}
+
+func (h imageHash) String() string {
+	return fmt.Sprintf("sha256=%s, dhash=%016x", h.sum, h.dhash)
+}
+
+// lastHash is the previous capture's hash and request id, a capture with
+// the same dhash is flagged as a duplicate of it
+type lastHash struct {
+	mu   sync.Mutex
+	hash imageHash
+	id   string
+}
+
+var previousCapture lastHash
+
+// swap records h as the latest capture and returns the id of the previous
+// one if it was the same image
+func (l *lastHash) swap(h imageHash, id string) (duplicateOf string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.id != "" && l.hash.dhash == h.dhash {
+		duplicateOf = l.id
+	}
+	l.hash, l.id = h, id
+	return duplicateOf
+}
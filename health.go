@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// how long a readiness result is reused so probes don't spawn python constantly
+const readyCacheTTL = 5 * time.Second
+
+// HandleHealthz is process liveness only, it never touches the sensor
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// HandleReadyz reports whether a capture could actually run, it checks the
+// python environment but not the sensor itself. A drained server isn't ready,
+// neither is one still waiting for the sensor at startup
+func HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining", "error": drainingMessage})
+		return
+	}
+	if waitingForSensor.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "waiting for sensor", "error": waitingForSensorMessage})
+		return
+	}
+	if err := ready.check(r.Context()); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// checkEnvironment makes sure the python executable runs and the capture
+// script is where we expect it
+func checkEnvironment(ctx context.Context) error {
+	if mockCapture {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := pythonVersion(ctx, pythonExecutable()); err != nil {
+		return err
+	}
+	if _, err := os.Stat(scriptPath); err != nil {
+		return fmt.Errorf("capture script: %w", err)
+	}
+	return nil
+}
+
+// pythonVersion is what python --version says, an error when it doesn't run
+func pythonVersion(ctx context.Context, python string) (string, error) {
+	out, err := exec.CommandContext(ctx, python, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("python executable %s isn't runnable: %v %s", python, err, bytes.TrimSpace(out))
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// readiness caches the last checkEnvironment result for readyCacheTTL
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+var ready readiness
+
+func (rd *readiness) check(ctx context.Context) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if !rd.checked.IsZero() && time.Since(rd.checked) < readyCacheTTL {
+		return rd.err
+	}
+	rd.err = checkEnvironment(ctx)
+	rd.checked = time.Now()
+	return rd.err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// -idle-timeout, how long without captures until the sensor is let go,
+	// 0 never does
+	idleTimeout time.Duration
+	// -idle-command and -wake-command, run when it goes idle and before the
+	// first capture after, like a usb power switch or a vendor sleep tool
+	idleCommand, wakeCommand []string
+)
+
+// how long -idle-command and -wake-command get
+const idleCommandTimeout = 30 * time.Second
+
+var sensorActivity struct {
+	// held while going idle or waking up, so a capture never runs in between
+	mu sync.Mutex
+	// captures, previews and status queries running right now
+	active atomic.Int32
+	// unix nanos of the last one starting or ending
+	last atomic.Int64
+	idle atomic.Bool
+	// unix nanos of going idle
+	idleSince atomic.Int64
+}
+
+// useSensor is called before anything goes to the sensor, it wakes it up
+// when it's idle. done is called once it's finished
+func useSensor(ctx context.Context) (done func()) {
+	a := &sensorActivity
+	a.mu.Lock()
+	a.active.Add(1)
+	a.last.Store(time.Now().UnixNano())
+	if a.idle.Load() {
+		idleFor := time.Since(time.Unix(0, a.idleSince.Load()))
+		logFor(ctx).Info("waking the sensor up", "event", "sensor_wake", "idle_for", idleFor.Round(time.Second).String())
+		runIdleCommand(ctx, "wake-command", wakeCommand)
+		a.idle.Store(false)
+	}
+	a.mu.Unlock()
+	return func() {
+		a.last.Store(time.Now().UnixNano())
+		a.active.Add(-1)
+	}
+}
+
+// watchIdle lets go of the sensor once nothing used it for idleTimeout,
+// until ctx is done
+func watchIdle(ctx context.Context) {
+	sensorActivity.last.Store(time.Now().UnixNano())
+	tick := time.NewTicker(max(idleTimeout/10, time.Second))
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			goIdle(ctx)
+		}
+	}
+}
+
+func goIdle(ctx context.Context) {
+	a := &sensorActivity
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.idle.Load() || a.active.Load() > 0 || time.Since(time.Unix(0, a.last.Load())) < idleTimeout {
+		return
+	}
+	slog.Info("no captures for a while, letting go of the sensor", "event", "sensor_idle", "idle_timeout", idleTimeout.String())
+	if pool != nil {
+		pool.Idle()
+	}
+	runIdleCommand(ctx, "idle-command", idleCommand)
+	a.idleSince.Store(time.Now().UnixNano())
+	a.idle.Store(true)
+}
+
+// runIdleCommand runs -idle-command or -wake-command, a failing one is only
+// logged
+func runIdleCommand(ctx context.Context, name string, command []string) {
+	if len(command) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), idleCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil {
+		logFor(ctx).Error("sensor "+name+" failed", "event", "sensor_idle_command_failed", "command", strings.Join(command, " "), "error", err.Error(), "output", string(out))
+	}
+}
+
+// sensorState is what /sensor/status says, "" without -idle-timeout
+func sensorState() string {
+	switch {
+	case idleTimeout == 0:
+		return ""
+	case sensorActivity.idle.Load():
+		return "idle"
+	}
+	return "active"
+}
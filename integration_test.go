@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// captureServer serves /capture like run does, with capture.py being the
+// shell script body and python a stub that runs it with sh
+func captureServer(t *testing.T, body string, blank float64) *httptest.Server {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub python is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sample.png"), samplePNG, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	python := filepath.Join(dir, "python")
+	if err := os.WriteFile(python, []byte("#!/bin/sh\nexec /bin/sh \"$@\"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "capture.py")
+	if err := os.WriteFile(script, []byte(body+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Python = python
+	cfg.BlankThreshold = blank
+	cfg.apply()
+	scriptPath = script
+	t.Cleanup(func() {
+		def := defaultConfig()
+		def.apply()
+		scriptPath = ""
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /capture", concurrencyMiddleWare(logRequest("capture", "sent fingerprint image", HandleCapture)))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCaptureIntegration(t *testing.T) {
+	// the blank check needs the whole image, without it the png streams
+	for _, mode := range []struct {
+		name  string
+		blank float64
+	}{{"buffered", 0.98}, {"streamed", 0}} {
+		t.Run(mode.name, func(t *testing.T) {
+			t.Run("success", func(t *testing.T) {
+				srv := captureServer(t, "cat \"$(dirname \"$0\")/sample.png\"; echo QUALITY=70 >&2", mode.blank)
+				resp, body := get(t, srv.URL+"/capture")
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status %d, want 200: %s", resp.StatusCode, body)
+				}
+				if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+					t.Errorf("Content-Type %q, want image/png", ct)
+				}
+				samePixels(t, body, samplePNG)
+				q := resp.Header.Get("X-Fingerprint-Quality")
+				if mode.blank == 0 {
+					q = resp.Trailer.Get("X-Fingerprint-Quality")
+				}
+				if q != "70" {
+					t.Errorf("X-Fingerprint-Quality %q, want 70", q)
+				}
+			})
+
+			t.Run("empty output", func(t *testing.T) {
+				srv := captureServer(t, "exit 0", mode.blank)
+				wantAPIError(t, srv.URL+"/capture", http.StatusInternalServerError, codeEmptyCapture)
+			})
+
+			t.Run("non-zero exit", func(t *testing.T) {
+				srv := captureServer(t, "echo 'sensor fell off' >&2; exit 1", mode.blank)
+				wantAPIError(t, srv.URL+"/capture", http.StatusInternalServerError, codeCaptureFailed)
+			})
+
+			t.Run("timeout", func(t *testing.T) {
+				srv := captureServer(t, "exec sleep 10", mode.blank)
+				start := time.Now()
+				wantAPIError(t, srv.URL+"/capture?timeout=500ms", http.StatusGatewayTimeout, codeCaptureTimeout)
+				if d := time.Since(start); d > 5*time.Second {
+					t.Errorf("took %s, the script wasn't killed at the timeout", d)
+				}
+			})
+		})
+	}
+}
+
+// at the defaults -busy is wait, a second capture has to queue for the
+// sensor instead of getting a 503 from -max-concurrent
+func TestCaptureQueuesAtDefaults(t *testing.T) {
+	srv := captureServer(t, "sleep 0.5; cat \"$(dirname \"$0\")/sample.png\"", 0.98)
+	type result struct {
+		status int
+		wait   string
+		body   []byte
+	}
+	results := make(chan result, 2)
+	for range 2 {
+		go func() {
+			resp, err := http.Get(srv.URL + "/capture")
+			if err != nil {
+				results <- result{body: []byte(err.Error())}
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			results <- result{resp.StatusCode, resp.Header.Get("X-Queue-Wait-Ms"), body}
+		}()
+	}
+	waited := 0
+	for range 2 {
+		res := <-results
+		if res.status != http.StatusOK {
+			t.Errorf("status %d, want 200: %s", res.status, res.body)
+		}
+		if res.wait != "" {
+			waited++
+		}
+	}
+	if waited != 1 {
+		t.Errorf("%d captures had X-Queue-Wait-Ms, want the one that queued", waited)
+	}
+}
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func wantAPIError(t *testing.T, url string, status int, code string) {
+	t.Helper()
+	resp, body := get(t, url)
+	if resp.StatusCode != status {
+		t.Errorf("status %d, want %d: %s", resp.StatusCode, status, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+	var e apiErrorBody
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("body isn't the error envelope: %v: %s", err, body)
+	}
+	if e.Error.Code != code {
+		t.Errorf("code %q, want %q", e.Error.Code, code)
+	}
+}
+
+// samePixels compares the decoded images, the server rewrites pHYs so the
+// bytes differ
+func samePixels(t *testing.T, got, want []byte) {
+	t.Helper()
+	g, err := png.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("answer isn't a png: %v", err)
+	}
+	w, err := png.Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Bounds() != w.Bounds() {
+		t.Fatalf("size %v, want %v", g.Bounds(), w.Bounds())
+	}
+	b := g.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if g.At(x, y) != w.At(x, y) {
+				t.Fatalf("pixel %v differs", image.Pt(x, y))
+			}
+		}
+	}
+}
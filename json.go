@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/png"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type captureJSON struct {
+	Format      string    `json:"format"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	CapturedAt  time.Time `json:"capturedAt"`
+	Quality     *int      `json:"quality,omitempty"`
+	Liveness    *int      `json:"liveness,omitempty"`
+	ImageBase64 string    `json:"imageBase64"`
+}
+
+// HandleCaptureJSON is HandleCapture for clients that can't deal with a raw
+// image body, the png comes back base64 encoded next to its size
+func HandleCaptureJSON(w http.ResponseWriter, r *http.Request) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("X-Capture-Timeout", timeout.String())
+
+	device, err := requestDevice(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	liveness, err := requestLiveness(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	done := trackCapture()
+	img, meta, attempts, err := captureBest(r.Context(), CaptureOptions{Device: device, Timeout: timeout, Liveness: liveness})
+	done(err)
+	if err != nil {
+		logError(r, err)
+		status, msg := captureStatus(err)
+		writeJSONError(w, status, msg)
+		return
+	}
+
+	debugCapture(w, r, meta, true)
+	setQualityHeaders(w, meta, attempts)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		logError(r, err)
+		writeJSONError(w, http.StatusInternalServerError, "Python script returned an invalid png")
+		return
+	}
+
+	out := captureJSON{
+		Format:      "png",
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		CapturedAt:  meta.CapturedAt.UTC(),
+		Quality:     meta.Quality,
+		Liveness:    meta.Liveness,
+		ImageBase64: base64.StdEncoding.EncodeToString(img),
+	}
+	if meta.Quality != nil {
+		if quality := *meta.Quality; quality < rejectQualityBelow {
+			logError(r, fmt.Errorf("quality %d is below %d", quality, rejectQualityBelow))
+			writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("Fingerprint quality %d is below %d, please scan again", quality, rejectQualityBelow))
+			return
+		}
+	}
+	// a rejected capture isn't kept
+	saveCapture(r.Context(), img, meta.CapturedAt, "png")
+	writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to write json response", "error", err.Error())
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// what a capture asked for liveness does when capture.py can't tell
+const (
+	livenessLenient = "lenient"
+	livenessStrict  = "strict"
+)
+
+var (
+	// -liveness-reject-below, a capture scoring under it is a suspected
+	// spoof. Above 0 every capture is checked, ?liveness=1 or not
+	livenessRejectBelow int
+	// -liveness-mode, lenient lets a capture without a score through
+	livenessMode = livenessLenient
+)
+
+var (
+	errSpoofSuspected      = errors.New("fingerprint looks spoofed")
+	errLivenessUnsupported = errors.New("liveness detection isn't supported by this sensor")
+)
+
+// spoofError is errSpoofSuspected with the score that got it rejected
+type spoofError struct {
+	score int
+}
+
+func (e *spoofError) Error() string {
+	return fmt.Sprintf("%s, liveness score %d is below %d", errSpoofSuspected, e.score, livenessRejectBelow)
+}
+
+func (e *spoofError) Is(target error) bool {
+	return target == errSpoofSuspected
+}
+
+// requestLiveness is ?liveness=1
+func requestLiveness(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("liveness"); v {
+	case "", "0":
+		return false, nil
+	case "1":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid liveness %q, want 1", v)
+	}
+}
+
+// Liveness is the 0-100 score capture.py reports on a "LIVENESS=<n>" line
+// for --liveness, 100 is surely a live finger. ok is false when it can't
+// tell
+func (c *captureResult) Liveness() (score int, ok bool) {
+	s, ok := c.reported("LIVENESS")
+	return min(max(s, 0), 100), ok
+}
+
+// checkLiveness applies -liveness-reject-below and -liveness-mode to the
+// score of a capture that asked for one
+func checkLiveness(ctx context.Context, score *int) error {
+	if score == nil {
+		if livenessMode == livenessStrict {
+			logFor(ctx).Warn("capture.py didn't report a liveness score, rejecting capture", "event", "liveness_unsupported")
+			return errLivenessUnsupported
+		}
+		return nil
+	}
+	if *score < livenessRejectBelow {
+		err := &spoofError{score: *score}
+		logFor(ctx).Warn("rejecting capture that looks spoofed", "event", "spoof_suspected", "liveness", *score, "reject_below", livenessRejectBelow)
+		return err
+	}
+	return nil
+}
+
+// livenessHeader is X-Liveness-Score for a capture that asked for one, none
+// when capture.py couldn't tell
+func livenessHeader(score *int) string {
+	if score == nil {
+		return "none"
+	}
+	return strconv.Itoa(*score)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logOutput is where the logs go, stderr or -log-file rotated once it's
+// maxSize megabytes, keeping maxBackups old files
+func logOutput(file string, maxSize, maxBackups int) io.Writer {
+	if file == "" {
+		return os.Stderr
+	}
+	return &lumberjack.Logger{Filename: file, MaxSize: maxSize, MaxBackups: maxBackups}
+}
+
+// setupLogging switches the default logger to json, text keeps the plain
+// log package lines we always had. Both go to out
+func setupLogging(format string, out io.Writer) error {
+	log.SetOutput(out)
+	switch format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, nil)))
+	case "text":
+	default:
+		return fmt.Errorf("invalid log format %q, want json or text", format)
+	}
+	return nil
+}
+
+// fatal is log.Fatal for slog
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type logInfoKey struct{}
+
+// logInfo is what a handler wants on its request log line besides the basics
+type logInfo struct {
+	err error
+	id  string
+	// logs everything for the request with its request_id
+	logger *slog.Logger
+}
+
+// incoming X-Request-ID values we'll take as is, anything else gets replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID is the id logRequest gave the request ctx belongs to
+func requestID(ctx context.Context) string {
+	if info, ok := ctx.Value(logInfoKey{}).(*logInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// logFor is the logger of the request ctx belongs to, or the default one
+// outside of a request
+func logFor(ctx context.Context) *slog.Logger {
+	if info, ok := ctx.Value(logInfoKey{}).(*logInfo); ok {
+		return info.logger
+	}
+	return slog.Default()
+}
+
+// logError attaches err to the request log line of r
+func logError(r *http.Request, err error) {
+	if info, ok := r.Context().Value(logInfoKey{}).(*logInfo); ok {
+		info.err = err
+	}
+}
+
+// statusWriter remembers the status code so it can be logged
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logWriter logs what's written to it line by line, for the output of
+// commands we run
+type logWriter struct {
+	msg, event string
+	level      slog.Level
+	partial    []byte
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		line, rest, found := bytes.Cut(l.partial, []byte("\n"))
+		if !found {
+			break
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			slog.Log(context.Background(), l.level, l.msg, "event", l.event, "line", string(bytes.TrimRight(line, "\r")))
+		}
+		l.partial = rest
+	}
+	return len(p), nil
+}
+
+// logRequest gives every request an id, echoed in X-Request-ID and put on
+// all its log lines, and logs one line with msg once next is done
+func logRequest(event, msg string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		sw := &statusWriter{ResponseWriter: w}
+		info := &logInfo{id: id, logger: slog.Default().With("request_id", id)}
+		r = r.WithContext(context.WithValue(r.Context(), logInfoKey{}, info))
+
+		// put it in a func because time.since won't be defered
+		defer func() {
+			attrs := []any{
+				"event", event,
+				"duration_ms", time.Since(now).Milliseconds(),
+				"status", sw.status,
+				"remote_addr", r.RemoteAddr,
+				"client_ip", clientAddr(r),
+				"user_agent", r.UserAgent(),
+			}
+			if info.err != nil {
+				attrs = append(attrs, "error", info.err.Error())
+			}
+			info.logger.Info(msg, attrs...)
+			recordRequest(event, id, now, sw.status, info.err)
+		}()
+
+		next(sw, r)
+	}
+}
@@ -1,88 +1,853 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
 const pythonScript = "capture.py"
 
+const defaultAddr = ":8080"
+
+var (
+	// absolute path of the capture script, resolved once in main
+	scriptPath string
+	// captures scoring under this get a 422 instead of the image, 0 accepts everything
+	rejectQualityBelow int
+	// how long capture.py gets before it's killed
+	captureTimeout = 30 * time.Second
+	// -max-timeout, upper bound for the per request ?timeout= so a client
+	// can't hold the sensor forever
+	maxCaptureTimeout = 2 * time.Minute
+	// parent of every capture.py run, canceled when shutdown gives up on
+	// draining so no python is left behind
+	capturesCtx, killCaptures = context.WithCancel(context.Background())
+)
+
 func main() {
-	http.HandleFunc("GET /capture", corsMiddleWare(HandleCapture))
-	log.Println("Starting server on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if inService() {
+		// windows starts services in system32, go where the exe is so
+		// ./venv, capture.py and relative paths work like when it's double
+		// clicked
+		if err := chdirToExecutable(); err != nil {
+			log.Fatalf("Can't change to the server's directory: %v", err)
+		}
+	}
+
+	cfg := defaultConfig()
+	configFile := configPath(os.Args[1:])
+	if configFile != "" {
+		if err := cfg.load(configFile); err != nil {
+			log.Fatalf("Can't load config %s: %v", configFile, err)
+		}
+	}
+
+	flag.StringVar(&configFile, "config", configFile, "yaml or toml file with the settings below, env vars and flags override it (env FP_CONFIG)")
+	flag.StringVar(&cfg.Addr, "addr", envOr("FP_SERVER_ADDR", cfg.Addr), "address to listen on (env FP_SERVER_ADDR)")
+	flag.StringVar(&cfg.Unix, "unix", envOr("FP_UNIX_SOCKET", cfg.Unix), "listen on this unix socket instead of tcp, can't be combined with -addr (env FP_UNIX_SOCKET)")
+	flag.BoolVar(&cfg.UnixLocal, "unix-local", envBool("FP_UNIX_LOCAL", cfg.UnixLocal), "count unix socket clients as local for ?dest=file, only when nothing proxies to the socket (env FP_UNIX_LOCAL)")
+	flag.BoolVar(&cfg.H2C, "h2c", envBool("FP_H2C", cfg.H2C), "also speak http2 without tls, http/1.1 clients are served as before (env FP_H2C)")
+	flag.StringVar(&cfg.GRPCAddr, "grpc-addr", envOr("FP_GRPC_ADDR", cfg.GRPCAddr), "also serve the grpc api on this address, empty is off (env FP_GRPC_ADDR)")
+	flag.StringVar(&cfg.Pprof, "pprof", envOr("FP_PPROF", cfg.Pprof), "serve net/http/pprof on this address, like localhost:6060, never on -addr. Empty is off, it has no auth (env FP_PPROF)")
+	flag.StringVar(&cfg.Script, "script", envOr("FP_CAPTURE_SCRIPT", cfg.Script), "path to the capture script (env FP_CAPTURE_SCRIPT)")
+	flag.StringVar(&cfg.Python, "python", envOr("FP_PYTHON", cfg.Python), "python to run the scripts with, empty uses ./venv or the one on the PATH (env FP_PYTHON)")
+	cfg.ScriptArgs = envList("FP_SCRIPT_ARGS", cfg.ScriptArgs)
+	flag.Var(&listFlag{list: &cfg.ScriptArgs}, "script-args", "argument appended to every capture.py run, repeat it for more, each one is passed as is without a shell (env FP_SCRIPT_ARGS, space separated)")
+	flag.StringVar(&cfg.ScriptCwd, "script-cwd", envOr("FP_SCRIPT_CWD", cfg.ScriptCwd), "working directory of capture.py and the other scripts, empty runs each in its own directory (env FP_SCRIPT_CWD)")
+	flag.Var(envFlag{env: &cfg.Env}, "env", "KEY=VALUE set for capture.py and the other scripts on top of the server's environment, repeat it for more (config file: an env map)")
+	flag.StringVar(&cfg.ScriptDir, "script-dir", envOr("FP_SCRIPT_DIR", cfg.ScriptDir), "where the embedded capture.py is written when -script isn't found (env FP_SCRIPT_DIR)")
+	flag.StringVar(&cfg.MatchScript, "match-script", envOr("FP_MATCH_SCRIPT", cfg.MatchScript), "path to the matcher script used by /match (env FP_MATCH_SCRIPT)")
+	flag.StringVar(&cfg.TemplateScript, "template-script", envOr("FP_TEMPLATE_SCRIPT", cfg.TemplateScript), "path to the template script used by /enroll and /verify (env FP_TEMPLATE_SCRIPT)")
+	flag.IntVar(&cfg.CheckRecentSize, "check-recent-size", envInt("FP_CHECK_RECENT_SIZE", cfg.CheckRecentSize), "how many of the last /capture/check-recent and /enroll templates a new print is compared with (env FP_CHECK_RECENT_SIZE)")
+	flag.Float64Var(&cfg.CheckRecentThreshold, "check-recent-threshold", envFloat("FP_CHECK_RECENT_THRESHOLD", cfg.CheckRecentThreshold), "template script score from which /capture/check-recent calls it a duplicate, 0 takes the script's match verdict (env FP_CHECK_RECENT_THRESHOLD)")
+	flag.StringVar(&cfg.TemplateDir, "template-dir", envOr("FP_TEMPLATE_DIR", cfg.TemplateDir), "directory enrolled templates are stored in (env FP_TEMPLATE_DIR)")
+	flag.DurationVar(&cfg.Timeout, "timeout", envDuration("FP_CAPTURE_TIMEOUT", cfg.Timeout), "how long a capture may take before it's killed (env FP_CAPTURE_TIMEOUT)")
+	flag.DurationVar(&cfg.MaxTimeout, "max-timeout", envDuration("FP_MAX_TIMEOUT", cfg.MaxTimeout), "longest ?timeout= a request may ask for, longer ones are cut down to it (env FP_MAX_TIMEOUT)")
+	flag.StringVar(&cfg.Busy, "busy", envOr("FP_BUSY_MODE", cfg.Busy), "what to do when the sensor is busy, wait or reject with 503 (env FP_BUSY_MODE)")
+	flag.DurationVar(&cfg.DrainTimeout, "drain-timeout", envDuration("FP_DRAIN_TIMEOUT", cfg.DrainTimeout), "how long in-flight requests get to finish on shutdown (env FP_DRAIN_TIMEOUT)")
+	flag.StringVar(&cfg.APIKey, "api-key", envOr("FP_API_KEY", cfg.APIKey), "require this key on capture endpoints, empty leaves them open (env FP_API_KEY)")
+	flag.StringVar(&cfg.BasicAuth, "basic-auth", envOr("FP_BASIC_AUTH", cfg.BasicAuth), "user:bcrypthash required as http basic auth on capture endpoints, with -api-key either one gets in (env FP_BASIC_AUTH)")
+	flag.StringVar(&cfg.URLSecret, "url-secret", envOr("FP_URL_SECRET", cfg.URLSecret), "key for signing one time capture urls with POST /admin/sign, empty turns them off (env FP_URL_SECRET)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", envOr("FP_TLS_CERT", cfg.TLSCert), "serve https with this certificate, needs -tls-key (env FP_TLS_CERT)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", envOr("FP_TLS_KEY", cfg.TLSKey), "private key for -tls-cert (env FP_TLS_KEY)")
+	flag.StringVar(&cfg.AutocertDomain, "autocert-domain", envOr("FP_AUTOCERT_DOMAIN", cfg.AutocertDomain), "serve https with a let's encrypt certificate for this domain (env FP_AUTOCERT_DOMAIN)")
+	flag.StringVar(&cfg.AutocertCache, "autocert-cache", envOr("FP_AUTOCERT_CACHE", cfg.AutocertCache), "directory let's encrypt certificates are kept in (env FP_AUTOCERT_CACHE)")
+	flag.StringVar(&cfg.CORSOrigin, "cors-origin", envOr("FP_CORS_ORIGIN", cfg.CORSOrigin), "origins browsers may call from, comma separated or * for any, empty sends no CORS headers (env FP_CORS_ORIGIN)")
+	flag.Float64Var(&cfg.Rate, "rate", envFloat("FP_RATE", cfg.Rate), "max captures per second across all clients, 0 is unlimited (env FP_RATE)")
+	flag.IntVar(&cfg.RateBurst, "rate-burst", envInt("FP_RATE_BURST", cfg.RateBurst), "captures allowed in a burst on top of -rate (env FP_RATE_BURST)")
+	flag.StringVar(&cfg.SaveDir, "save-dir", envOr("FP_SAVE_DIR", cfg.SaveDir), "also write every capture to this directory (env FP_SAVE_DIR)")
+	flag.StringVar(&cfg.SaveEncryptKey, "save-encrypt-key", envOr("FP_SAVE_ENCRYPT_KEY", cfg.SaveEncryptKey), "hex AES key saved captures are encrypted with (AES-GCM), they get a .enc on top of their name (env FP_SAVE_ENCRYPT_KEY)")
+	flag.IntVar(&cfg.SaveKeep, "save-keep", envInt("FP_SAVE_KEEP", cfg.SaveKeep), "only keep this many of the most recent saved captures, 0 keeps all (env FP_SAVE_KEEP)")
+	flag.BoolVar(&cfg.RelativeToCwd, "relative-to-cwd", envBool("FP_RELATIVE_TO_CWD", cfg.RelativeToCwd), "look for relative -script, -match-script, -template-script, the venv and requirements.txt in the working directory instead of next to the executable (env FP_RELATIVE_TO_CWD)")
+	flag.BoolVar(&cfg.StrictStartup, "strict-startup", envBool("FP_STRICT_STARTUP", cfg.StrictStartup), "exit at startup when python doesn't run or the capture script is missing instead of only warning (env FP_STRICT_STARTUP)")
+	flag.BoolVar(&cfg.Bootstrap, "bootstrap", envBool("FP_BOOTSTRAP", cfg.Bootstrap), "create the venv and pip install requirements.txt into it when it's missing (env FP_BOOTSTRAP)")
+	cfg.SelfTest = envOr("FP_SELFTEST", cfg.SelfTest)
+	flag.Var(selfTestFlag{mode: &cfg.SelfTest}, "selftest", "ask the sensor for its status through capture.py once before serving and log the outcome, =fatal exits when it fails (env FP_SELFTEST)")
+	flag.DurationVar(&cfg.WaitForSensor, "wait-for-sensor", envDuration("FP_WAIT_FOR_SENSOR", cfg.WaitForSensor), "at startup ask capture.py for the sensor until it's connected or this much time has gone by, /readyz is red and captures get a 503 meanwhile, 0 doesn't wait (env FP_WAIT_FOR_SENSOR)")
+	flag.BoolVar(&cfg.Mock, "mock", envBool("FP_MOCK", cfg.Mock), "serve a bundled sample image instead of running capture.py, for development without a sensor (env FP_MOCK)")
+	flag.BoolVar(&cfg.Worker, "worker", envBool("FP_WORKER", cfg.Worker), "keep capture.py running and send it the captures instead of starting python for each (env FP_WORKER)")
+	flag.IntVar(&cfg.Workers, "workers", envInt("FP_WORKERS", cfg.Workers), "how many capture workers -worker runs (env FP_WORKERS)")
+	flag.StringVar(&cfg.WorkerDevices, "worker-devices", envOr("FP_WORKER_DEVICES", cfg.WorkerDevices), "comma separated sensor ids, one capture worker each, ?device= picks the worker (env FP_WORKER_DEVICES)")
+	flag.IntVar(&cfg.QueueSize, "queue-size", envInt("FP_QUEUE_SIZE", cfg.QueueSize), "captures that may wait for a busy worker, more get a 503 (env FP_QUEUE_SIZE)")
+	flag.DurationVar(&cfg.WorkerBackoff, "worker-backoff", envDuration("FP_WORKER_BACKOFF", cfg.WorkerBackoff), "how long a crashed capture worker waits before it's started again, doubled for every crash in a row, captures get a 503 meanwhile (env FP_WORKER_BACKOFF)")
+	flag.DurationVar(&cfg.WorkerBackoffMax, "worker-backoff-max", envDuration("FP_WORKER_BACKOFF_MAX", cfg.WorkerBackoffMax), "longest -worker-backoff gets (env FP_WORKER_BACKOFF_MAX)")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", envDuration("FP_IDLE_TIMEOUT", cfg.IdleTimeout), "without captures for this long stop the -worker processes and run -idle-command, the next capture starts them again, 0 is never (env FP_IDLE_TIMEOUT)")
+	flag.StringVar(&cfg.IdleCommand, "idle-command", envOr("FP_IDLE_COMMAND", cfg.IdleCommand), "command run when the sensor goes idle, like one that powers the usb port down, split on spaces without a shell (env FP_IDLE_COMMAND)")
+	flag.StringVar(&cfg.WakeCommand, "wake-command", envOr("FP_WAKE_COMMAND", cfg.WakeCommand), "command run before the first capture after -idle-timeout, split on spaces without a shell (env FP_WAKE_COMMAND)")
+	flag.IntVar(&cfg.MaxQueue, "max-queue", envInt("FP_MAX_QUEUE", cfg.MaxQueue), "captures that may wait for the busy sensor, more get a 503 with X-Queue-Length, 0 is no limit, -worker uses -queue-size (env FP_MAX_QUEUE)")
+	flag.IntVar(&cfg.Attempts, "attempts", envInt("FP_CAPTURE_ATTEMPTS", cfg.Attempts), "how many times a failing capture.py is run before giving up (env FP_CAPTURE_ATTEMPTS)")
+	flag.IntVar(&cfg.DPI, "dpi", envInt("FP_DPI", cfg.DPI), "resolution written into png captures and sent as X-Image-DPI, ?dpi= overrides it (env FP_DPI)")
+	flag.IntVar(&cfg.MaxImageBytes, "max-image-bytes", envInt("FP_MAX_IMAGE_BYTES", cfg.MaxImageBytes), "capture.py writing more than this to stdout is killed and the capture fails with 502 (env FP_MAX_IMAGE_BYTES)")
+	flag.IntVar(&cfg.MaxUploadBytes, "max-upload-bytes", envInt("FP_MAX_UPLOAD_BYTES", cfg.MaxUploadBytes), "the most a /match, /process or /verify request body can be, more gets a 413 (env FP_MAX_UPLOAD_BYTES)")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", envDuration("FP_READ_TIMEOUT", cfg.ReadTimeout), "how long a client gets to send a whole request, uploads included, 0 is no limit (env FP_READ_TIMEOUT)")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", envDuration("FP_WRITE_TIMEOUT", cfg.WriteTimeout), "how long a request may take until its answer is sent, has to be above -max-timeout, 0 fits the slowest capture (env FP_WRITE_TIMEOUT)")
+	flag.DurationVar(&cfg.HTTPIdleTimeout, "http-idle-timeout", envDuration("FP_HTTP_IDLE_TIMEOUT", cfg.HTTPIdleTimeout), "how long an idle keep-alive connection stays open, 0 is -read-timeout (env FP_HTTP_IDLE_TIMEOUT)")
+	flag.BoolVar(&cfg.TrustProxy, "trust-proxy", envBool("FP_TRUST_PROXY", cfg.TrustProxy), "log and limit clients by the X-Forwarded-For address, only behind a proxy that sets it (env FP_TRUST_PROXY)")
+	flag.BoolVar(&cfg.Normalize, "normalize", envBool("FP_NORMALIZE", cfg.Normalize), "stretch the contrast of /capture images, for scans that come out too dark (env FP_NORMALIZE)")
+	flag.Float64Var(&cfg.Gamma, "gamma", envFloat("FP_GAMMA", cfg.Gamma), "gamma applied to /capture images, above 1 brightens (env FP_GAMMA)")
+	flag.BoolVar(&cfg.Hash, "hash", envBool("FP_HASH", cfg.Hash), "send X-Image-Hash with /capture and X-Duplicate-Of when it's the same image as the capture before (env FP_HASH)")
+	flag.Float64Var(&cfg.BlankThreshold, "blank-threshold", envFloat("FP_BLANK_THRESHOLD", cfg.BlankThreshold), "share of pixels of one shade above which a capture counts as no finger and gets a 422, 0 turns the check off (env FP_BLANK_THRESHOLD)")
+	flag.IntVar(&cfg.MaxConcurrent, "max-concurrent", envInt("FP_MAX_CONCURRENT", cfg.MaxConcurrent), "captures that may run at once, more get a 503 with Retry-After, 0 is what -max-queue or -workers and -queue-size take (env FP_MAX_CONCURRENT)")
+	flag.IntVar(&cfg.MaxPerClient, "max-per-client", envInt("FP_MAX_PER_CLIENT", cfg.MaxPerClient), "captures one client address may have in flight, more get a 429, 0 is no limit (env FP_MAX_PER_CLIENT)")
+	flag.DurationVar(&cfg.CacheTTL, "cache-ttl", envDuration("FP_CACHE_TTL", cfg.CacheTTL), "answer /capture from the last good capture for this long, ?fresh=1 skips it, 0 is off (env FP_CACHE_TTL)")
+	flag.IntVar(&cfg.MinQuality, "min-quality", envInt("FP_MIN_QUALITY", cfg.MinQuality), "capture again when capture.py reports a quality score under this and send the best, 0 takes the first capture (env FP_MIN_QUALITY)")
+	flag.IntVar(&cfg.QualityRetries, "quality-retries", envInt("FP_QUALITY_RETRIES", cfg.QualityRetries), "how many more captures -min-quality takes at most (env FP_QUALITY_RETRIES)")
+	flag.IntVar(&cfg.LivenessRejectBelow, "liveness-reject-below", envInt("FP_LIVENESS_REJECT_BELOW", cfg.LivenessRejectBelow), "ask capture.py for a liveness score on every capture and answer 403 SPOOF_SUSPECTED under this, 0 only checks with ?liveness=1 and never rejects (env FP_LIVENESS_REJECT_BELOW)")
+	flag.StringVar(&cfg.LivenessMode, "liveness-mode", envOr("FP_LIVENESS_MODE", cfg.LivenessMode), "lenient lets a capture through when capture.py can't tell liveness, strict answers 501 (env FP_LIVENESS_MODE)")
+	flag.IntVar(&cfg.RejectQualityBelow, "reject-quality-below", envInt("FP_REJECT_QUALITY_BELOW", cfg.RejectQualityBelow), "answer 422 when capture.py reports a quality score under this, 0 never rejects (env FP_REJECT_QUALITY_BELOW)")
+	flag.StringVar(&cfg.WebhookURL, "webhook-url", envOr("FP_WEBHOOK_URL", cfg.WebhookURL), "post every successful /capture as json to this url, failures are only logged (env FP_WEBHOOK_URL)")
+	flag.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", envDuration("FP_WEBHOOK_TIMEOUT", cfg.WebhookTimeout), "how long one webhook delivery may take (env FP_WEBHOOK_TIMEOUT)")
+	flag.IntVar(&cfg.WebhookAttempts, "webhook-attempts", envInt("FP_WEBHOOK_ATTEMPTS", cfg.WebhookAttempts), "how many times a failing webhook is tried (env FP_WEBHOOK_ATTEMPTS)")
+	flag.BoolVar(&cfg.Debug, "debug", envBool("FP_DEBUG", cfg.Debug), "log capture.py's output of successful captures too and send it as X-Capture-Warnings (env FP_DEBUG)")
+	flag.StringVar(&cfg.LogFormat, "log-format", envOr("FP_LOG_FORMAT", cfg.LogFormat), "log output, json or text (env FP_LOG_FORMAT)")
+	flag.StringVar(&cfg.LogFile, "log-file", envOr("FP_LOG_FILE", cfg.LogFile), "write the logs to this file instead of stderr, it's rotated by size (env FP_LOG_FILE)")
+	flag.IntVar(&cfg.LogMaxSize, "log-max-size", envInt("FP_LOG_MAX_SIZE", cfg.LogMaxSize), "megabytes -log-file grows to before it's rotated (env FP_LOG_MAX_SIZE)")
+	flag.IntVar(&cfg.LogMaxBackups, "log-max-backups", envInt("FP_LOG_MAX_BACKUPS", cfg.LogMaxBackups), "rotated log files kept, 0 keeps all (env FP_LOG_MAX_BACKUPS)")
+	printVersion := flag.Bool("version", false, "print the build version and exit")
+	check := flag.Bool("check", false, "check the config, python, the scripts, the directories and the ports like startup does, print a report and exit, 1 when something failed")
+	decryptPath := flag.String("decrypt", "", "write this capture saved with -save-encrypt-key to stdout decrypted and exit")
+	serviceMode := flag.String("service", "", "install or uninstall the server as a windows service with the other flags given, run is what the service starts it with")
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *check {
+		runCheck(cfg, configFile)
+	}
+	if *decryptPath != "" {
+		if err := decryptFile(cfg.SaveEncryptKey, *decryptPath); err != nil {
+			log.Fatalf("Can't decrypt: %v", err)
+		}
+		return
+	}
+
+	switch *serviceMode {
+	case "":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		run(ctx, cfg, configFile)
+	case "install":
+		if err := installService(serviceArgs(os.Args[1:])); err != nil {
+			log.Fatalf("Can't install the service: %v", err)
+		}
+		fmt.Printf("Installed the %s service\n", serviceName)
+	case "uninstall":
+		if err := uninstallService(); err != nil {
+			log.Fatalf("Can't uninstall the service: %v", err)
+		}
+		fmt.Printf("Uninstalled the %s service\n", serviceName)
+	case "run":
+		err := runService(func(ctx context.Context) {
+			run(ctx, cfg, configFile)
+		})
+		if err != nil {
+			log.Fatalf("Can't run as a service: %v", err)
+		}
+	default:
+		log.Fatalf("Invalid -service %q, want install, uninstall or run", *serviceMode)
+	}
 }
 
-func HandleCapture(w http.ResponseWriter, r *http.Request) {
-	now := time.Now()
-	// put it in a func because time.since won't be defered
-	defer func() {
-		log.Printf("sent fingerprint image and took %s", time.Since(now))
+// run serves until ctx is done and everything in flight has finished
+func run(ctx context.Context, cfg Config, configFile string) {
+	if err := setupLogging(cfg.LogFormat, logOutput(cfg.LogFile, cfg.LogMaxSize, cfg.LogMaxBackups)); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		fatal("invalid config", "error", err.Error())
+	}
+	cfg.apply()
+	if configFile != "" {
+		slog.Info("loaded config file", "path", configFile)
+	}
+	tlsOpts := cfg.tlsOptions()
+
+	if saveDir != "" {
+		if err := os.MkdirAll(saveDir, 0o700); err != nil {
+			fatal("can't create save directory", "path", saveDir, "error", err.Error())
+		}
+		slog.Info("saving captures", "path", saveDir, "keep", saveKeep, "encrypted", saveKey != nil)
+		if saveKey == nil {
+			slog.Warn("saved captures are biometric data and are written unencrypted, set -save-encrypt-key")
+		}
+	}
+
+	if err := findAppDir(); err != nil {
+		fatal("can't find the server's directory, try -relative-to-cwd", "error", err.Error())
+	}
+	if !relativeToCwd {
+		slog.Info("looking for scripts and the venv next to the executable", "dir", appDir, "venv", venvPython())
+	} else {
+		cwd, _ := os.Getwd()
+		slog.Info("looking for scripts and the venv in the working directory", "dir", cwd, "venv", venvPython())
+	}
+
+	if cfg.Bootstrap && !mockCapture {
+		if err := bootstrapVenv(context.Background()); err != nil {
+			fatal("can't bootstrap the python venv", "error", err.Error())
+		}
+	}
+
+	if err := resolveScriptCwd(); err != nil {
+		fatal("bad script working directory", "path", cfg.ScriptCwd, "error", err.Error())
+	}
+	if err := resolvePython(); err != nil {
+		fatal("bad python", "path", cfg.Python, "error", err.Error())
+	}
+	embedded, err := resolveScript(cfg)
+	if err != nil {
+		fatal("bad capture script", "path", cfg.Script, "error", err.Error())
+	}
+	if mockCapture {
+		slog.Warn("mock mode is on, captures are a bundled sample image and never touch the sensor")
+	} else {
+		if embedded {
+			if scriptPath, err = extractCaptureScript(cfg.ScriptDir); err != nil {
+				fatal("can't extract the embedded capture script", "dir", cfg.ScriptDir, "error", err.Error())
+			}
+			slog.Info("no capture.py found, using the embedded one", "path", scriptPath)
+		}
+		slog.Info("using capture script", "path", scriptPath, "python", pythonExecutable(), "cwd", scriptWorkDir(scriptPath))
+	}
+	if err := setupBackends(cfg.Backends); err != nil {
+		fatal("can't set up backend", "error", err.Error())
+	}
+	for _, b := range backends {
+		slog.Info("using capture backend", "backend", b.name, "path", b.script, "python", b.pythonExecutable())
+	}
+
+	matchScriptPath, err = filepath.Abs(appPath(cfg.MatchScript))
+	if err != nil {
+		fatal("can't resolve matcher script path", "path", cfg.MatchScript, "error", err.Error())
+	}
+	if _, err := os.Stat(matchScriptPath); err != nil {
+		slog.Warn("matcher script not found, /match won't work", "path", matchScriptPath)
+	}
+
+	templateScriptPath, err = filepath.Abs(appPath(cfg.TemplateScript))
+	if err != nil {
+		fatal("can't resolve template script path", "path", cfg.TemplateScript, "error", err.Error())
+	}
+	if _, err := os.Stat(templateScriptPath); err != nil {
+		slog.Warn("template script not found, /enroll and /verify won't work", "path", templateScriptPath)
+	}
+	if templates, err = newFileTemplateStore(cfg.TemplateDir); err != nil {
+		fatal("can't create template directory", "path", cfg.TemplateDir, "error", err.Error())
+	}
+	if !authRequired() {
+		slog.Warn("no api key or basic auth configured, capture endpoints are open to anyone who can reach them")
+	}
+
+	if err := ready.check(context.Background()); err != nil {
+		if cfg.StrictStartup {
+			fatal("environment isn't ready for captures", "error", err.Error())
+		}
+		// the server still starts so /healthz and /readyz can say what's
+		// wrong, captures fail with PYTHON_MISSING meanwhile
+		slog.Warn("ENVIRONMENT ISN'T READY, captures will fail until python and the capture script are there, -strict-startup exits instead", "event", "environment_not_ready", "error", err.Error())
+	}
+	if cfg.Worker && !mockCapture {
+		pool = newWorkerPool(cfg.Workers, cfg.workerDevices(), cfg.QueueSize)
+		if cfg.MaxConcurrent > 0 && cfg.MaxConcurrent < len(pool.workers) {
+			slog.Warn("max-concurrent is below the number of capture workers, some will sit idle", "max_concurrent", cfg.MaxConcurrent, "workers", len(pool.workers))
+		}
+		pool.Start()
+	}
+	// with -wait-for-sensor the self test waits for the sensor too
+	waitSensor := cfg.WaitForSensor > 0 && !mockCapture
+	if cfg.SelfTest != "" && !waitSensor {
+		runSelfTest(context.Background(), cfg.SelfTest)
+	}
+
+	http.HandleFunc("GET /capture", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("capture", "sent fingerprint image", HandleCapture)))))))
+	http.HandleFunc("GET /capture/batch", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("capture_batch", "sent fingerprint batch", noTimeoutMiddleWare(HandleCaptureBatch))))))))
+	http.HandleFunc("GET /capture/events", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("capture_events", "sent fingerprint events", noTimeoutMiddleWare(HandleCaptureEvents))))))))
+	http.HandleFunc("GET /capture.json", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("capture_json", "sent fingerprint json", HandleCaptureJSON)))))))
+	http.HandleFunc("GET /preview", authMiddleWare(drainMiddleWare(logRequest("preview", "preview ended", noTimeoutMiddleWare(HandlePreview)))))
+	http.HandleFunc("GET /stream.mjpeg", corsMiddleWare(authMiddleWare(drainMiddleWare(logRequest("mjpeg", "mjpeg stream ended", noTimeoutMiddleWare(HandleMJPEG))))))
+	http.HandleFunc("GET /sensor/status", corsMiddleWare(authMiddleWare(logRequest("sensor_status", "sent sensor status", HandleSensorStatus))))
+	http.HandleFunc("GET /sensor/finger", corsMiddleWare(authMiddleWare(drainMiddleWare(logRequest("sensor_finger", "sent finger presence", HandleSensorFinger)))))
+	http.HandleFunc("POST /sensor/calibrate", corsMiddleWare(authMiddleWare(drainMiddleWare(logRequest("sensor_calibrate", "ran sensor calibration", HandleSensorMaintenance("calibrate"))))))
+	http.HandleFunc("POST /sensor/clean", corsMiddleWare(authMiddleWare(drainMiddleWare(logRequest("sensor_clean", "ran sensor cleaning check", HandleSensorMaintenance("clean"))))))
+	http.HandleFunc("GET /sensor/capabilities", corsMiddleWare(authMiddleWare(logRequest("sensor_capabilities", "sent sensor capabilities", HandleSensorCapabilities))))
+	http.HandleFunc("GET /sensor/list", corsMiddleWare(authMiddleWare(logRequest("sensor_list", "sent sensor list", HandleSensorList))))
+	http.HandleFunc("POST /match", corsMiddleWare(authMiddleWare(logRequest("match", "matched fingerprints", uploadLimitMiddleWare(HandleMatch)))))
+	http.HandleFunc("POST /process", corsMiddleWare(authMiddleWare(logRequest("process", "processed fingerprint image", uploadLimitMiddleWare(HandleProcess)))))
+	http.HandleFunc("POST /enroll", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("enroll", "enrolled fingerprint", HandleEnroll)))))))
+	http.HandleFunc("POST /capture/check-recent", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("check_recent", "checked fingerprint against recent captures", HandleCheckRecent)))))))
+	http.HandleFunc("GET /template", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("template", "sent fingerprint template", HandleTemplate)))))))
+	http.HandleFunc("POST /verify", corsMiddleWare(authMiddleWare(drainMiddleWare(rateLimitMiddleWare(concurrencyMiddleWare(logRequest("verify", "verified fingerprint", uploadLimitMiddleWare(HandleVerify))))))))
+	for _, path := range []string{"/capture", "/capture.json", "/capture/events", "/capture/batch", "/match", "/process", "/enroll", "/verify", "/template", "/capture/check-recent", "/sensor/status", "/sensor/finger", "/sensor/calibrate", "/sensor/clean", "/sensor/list", "/sensor/capabilities"} {
+		http.HandleFunc("OPTIONS "+path, corsMiddleWare(corsPreflight))
+	}
+	http.HandleFunc("POST /admin/drain", adminMiddleWare(logRequest("drain", "drained captures", HandleDrain)))
+	http.HandleFunc("POST /admin/resume", adminMiddleWare(logRequest("resume", "resumed captures", HandleResume)))
+	http.HandleFunc("GET /file/{token}", authMiddleWare(logRequest("capture_file", "sent capture file", HandleCaptureFile)))
+	http.HandleFunc("DELETE /file/{token}", authMiddleWare(logRequest("capture_file_delete", "deleted capture file", HandleDeleteCaptureFile)))
+	http.HandleFunc("POST /admin/sign", adminMiddleWare(logRequest("sign_url", "signed capture url", HandleSignURL)))
+	http.HandleFunc("GET /admin/recent", adminMiddleWare(HandleRecent))
+	http.HandleFunc("GET /healthz", HandleHealthz)
+	http.HandleFunc("GET /readyz", HandleReadyz)
+	http.HandleFunc("GET /version", corsMiddleWare(HandleVersion))
+	http.Handle("GET /metrics", promhttp.Handler())
+
+	var ln net.Listener
+	if cfg.Unix != "" {
+		if ln, err = listenUnix(cfg.Unix); err != nil {
+			fatal("can't listen on unix socket", "path", cfg.Unix, "error", err.Error())
+		}
+	} else {
+		if ln, err = net.Listen("tcp", cfg.Addr); err != nil {
+			if errors.Is(err, syscall.EADDRINUSE) {
+				fatal("address already in use, pick another one with -addr or FP_SERVER_ADDR", "addr", cfg.Addr)
+			}
+			fatal("can't listen", "addr", cfg.Addr, "error", err.Error())
+		}
+	}
+
+	srv := &http.Server{
+		Handler:           gzipMiddleWare(hidePprof(http.DefaultServeMux.ServeHTTP)),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.writeTimeout(),
+		IdleTimeout:       cfg.HTTPIdleTimeout,
+	}
+	if cfg.H2C {
+		// http2 without tls, for clients that upgrade or know to start with it
+		h2s := &http2.Server{}
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			fatal("can't set up h2c", "error", err.Error())
+		}
+	}
+
+	var grpcSrv *grpc.Server
+	if cfg.GRPCAddr != "" {
+		if grpcSrv, err = newGRPCServer(tlsOpts); err != nil {
+			fatal("can't set up grpc server", "error", err.Error())
+		}
+		go serveGRPC(grpcSrv, cfg.GRPCAddr, tlsOpts.certFile != "")
+	}
+	if cfg.Pprof != "" {
+		go servePprof(cfg.Pprof)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		slog.Info("shutting down, draining in-flight requests", "drain_timeout", cfg.DrainTimeout.String())
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		defer cancel()
+		grpcStopped := make(chan struct{})
+		go func() {
+			defer close(grpcStopped)
+			if grpcSrv != nil {
+				grpcSrv.GracefulStop()
+			}
+		}()
+		err := srv.Shutdown(shutdownCtx)
+		if err == nil {
+			select {
+			case <-grpcStopped:
+			case <-shutdownCtx.Done():
+				err = shutdownCtx.Err()
+			}
+		}
+		if err != nil {
+			slog.Warn("drain timed out, killing in-flight captures", "error", err.Error())
+			killCaptures()
+			srv.Close()
+			if grpcSrv != nil {
+				grpcSrv.Stop()
+			}
+			runningCaptures.Wait()
+		}
 	}()
 
-	pythonExec := "python3"
-	venvPythonPath := filepath.Join("venv", "bin", "python3")
-	if runtime.GOOS == "windows" {
-		venvPythonPath = filepath.Join("venv", "Scripts", "python.exe")
+	if waitSensor {
+		// /healthz is up meanwhile, /readyz and captures wait with us
+		waitingForSensor.Store(true)
+		go func() {
+			waitForSensor(ctx, cfg.WaitForSensor)
+			waitingForSensor.Store(false)
+			if cfg.SelfTest != "" && ctx.Err() == nil {
+				runSelfTest(ctx, cfg.SelfTest)
+			}
+		}()
+	}
+	if idleTimeout > 0 && !mockCapture {
+		go watchIdle(ctx)
+	}
+
+	if err := serve(srv, ln, tlsOpts); !errors.Is(err, http.ErrServerClosed) {
+		fatal("server stopped", "error", err.Error())
+	}
+	<-stopped
+	if pool != nil {
+		pool.Stop()
+	}
+	pendingWebhooks.Wait()
+	removeCaptureFiles()
+	slog.Info("server stopped")
+}
+
+// envOr returns the value of the env var key or def when it's unset or empty
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration is envOr for durations, a value that doesn't parse is fatal
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid duration in %s: %v", key, err)
+	}
+	return d
+}
+
+// envBool is envOr for switches, a value that doesn't parse is fatal
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid switch in %s: %v", key, err)
+	}
+	return b
+}
+
+// envFloat is envOr for numbers, a value that doesn't parse is fatal
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid number in %s: %v", key, err)
+	}
+	return f
+}
+
+// envInt is envOr for whole numbers, a value that doesn't parse is fatal
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid number in %s: %v", key, err)
 	}
+	return i
+}
 
-	pythonExec = "python3"
-	if runtime.GOOS == "windows" {
-		pythonExec = "python"
+// envList is envOr for lists, split on whitespace
+func envList(key string, def []string) []string {
+	if v := os.Getenv(key); v != "" {
+		return strings.Fields(v)
 	}
+	return def
+}
 
-	if _, err := os.Stat(venvPythonPath); err == nil {
-		log.Println("Found virtual environment python executable at", venvPythonPath)
-		venvPythonPath, _ = filepath.Abs(venvPythonPath)
-		pythonExec = venvPythonPath
+// listFlag is a flag that can be given more than once. The first one
+// replaces what the config file or env said, later ones add to it
+type listFlag struct {
+	list *[]string
+	set  bool
+}
+
+func (f *listFlag) String() string {
+	if f.list == nil {
+		return ""
 	}
+	return strings.Join(*f.list, " ")
+}
+
+func (f *listFlag) Set(v string) error {
+	if !f.set {
+		*f.list, f.set = nil, true
+	}
+	*f.list = append(*f.list, v)
+	return nil
+}
 
-	cmd := exec.Command(pythonExec, pythonScript)
+// envFlag is a repeatable KEY=VALUE flag, added to the env map of the
+// config file
+type envFlag struct {
+	env *map[string]string
+}
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	// will get nice python panics with this baby
-	cmd.Stderr = &stderrBuf
+func (f envFlag) String() string {
+	if f.env == nil {
+		return ""
+	}
+	var pairs []string
+	for k, v := range *f.env {
+		pairs = append(pairs, k+"="+v)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, " ")
+}
 
-	err := cmd.Run()
+func (f envFlag) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("want KEY=VALUE, got %q", v)
+	}
+	if *f.env == nil {
+		*f.env = map[string]string{}
+	}
+	(*f.env)[k] = val
+	return nil
+}
+
+// requestTimeout picks the capture timeout for r, ?timeout= overrides the
+// server default but is clamped to maxCaptureTimeout. Handlers send what
+// they got as X-Capture-Timeout
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("timeout")
+	if v == "" {
+		return captureTimeout, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", v)
+	}
+	return min(d, maxCaptureTimeout), nil
+}
+
+// image formats capture.py can produce, ?format= value -> content type
+var formats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"bmp":  "image/bmp",
+	"wsq":  "image/x-wsq",
+}
+
+func HandleCapture(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("bundle") {
+		HandleCaptureBundle(w, r)
+		return
+	}
+	timeout, err := requestTimeout(r)
 	if err != nil {
-		log.Printf("Failed to capture fingerprint %v", err)
-		log.Printf("Python stdout:\n%s\n", stdoutBuf.String())
-		log.Printf("Python stderr:\n%s\n", stderrBuf.String())
-		http.Error(w, "Failed to capture fingerprint: "+stderrBuf.String(), http.StatusInternalServerError)
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
 		return
 	}
+	w.Header().Set("X-Capture-Timeout", timeout.String())
 
-	if stdoutBuf.Len() == 0 {
-		log.Println("Python script returned empty output.")
-		http.Error(w, "No data received from Python script", http.StatusInternalServerError)
+	// an explicit ?format= wins over the Accept header
+	w.Header().Add("Vary", "Accept")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		var ok bool
+		if format, ok = negotiateFormat(r.Header.Get("Accept")); !ok {
+			writeAPIError(w, r, http.StatusNotAcceptable, codeNotAcceptable, "none of the accepted types can be captured, want image/png, image/jpeg, image/bmp, image/x-wsq, application/octet-stream, application/x-ansi-nist or text/uri-list")
+			return
+		}
+	}
+	contentType, ok := formatContentType(format)
+	if !ok {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("unsupported format %q, want png, jpeg, bmp, wsq, raw, nist or datauri", format))
+		return
+	}
+	dest := r.URL.Query().Get("dest")
+	switch {
+	case dest != "" && dest != "file":
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("unsupported dest %q, want file", dest))
 		return
+	case dest == "file" && !localRequest(r):
+		writeAPIError(w, r, http.StatusForbidden, codeForbidden, "dest=file is only for clients on this machine")
+		return
+	}
+	captureFormat := format
+	if format == "raw" || format == "nist" || format == "datauri" {
+		captureFormat = "png"
+	}
+	var nist nistInfo
+	if format == "nist" {
+		if nist, err = parseNISTInfo(r); err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
 	}
 
-	// made the capture.py script send png to stdout so no need to handle different image types
-	w.Header().Set("Content-Type", "image/png")
+	device, err := requestDevice(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
 
-	_, err = io.Copy(w, &stdoutBuf)
+	t, err := parseTransform(r)
 	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
 		return
 	}
 
-}
+	dpi, err := requestDPI(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	resolution, err := requestResolution(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if format == "wsq" {
+		if err := checkWSQ(r, t, resolution); err != nil {
+			writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		// no -normalize or -gamma either, wsq goes out as capture.py wrote it
+		t = transform{}
+		dpi = wsqDPI
+	}
+
+	backend, err := requestBackend(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	liveness, err := requestLiveness(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	embedMetadata, err := requestEmbedMetadata(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	if embedMetadata && format != "png" && format != "datauri" {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("metadata=embedded is for png, not %s", format))
+		return
+	}
 
-func corsMiddleWare(callback func(w http.ResponseWriter, r *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, auth")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+	opts := CaptureOptions{Format: captureFormat, Device: device, Resolution: resolution, Timeout: timeout, Backend: backend, Liveness: liveness}
+	if canStream(r, opts, t, format, dest, embedMetadata) {
+		// a streamed png is tagged with the resolution asked for, the
+		// one capture.py reports comes too late
+		if resolution > 0 && r.URL.Query().Get("dpi") == "" {
+			dpi = resolution
+		}
+		HandleCaptureStream(w, r, opts, dpi)
+		return
+	}
+	cacheKey := opts.key()
 
-		callback(w, r)
+	img, meta, hit := lastCapture.get(cacheKey)
+	if r.URL.Query().Get("fresh") == "1" {
+		hit = false
+	}
+	attempts := 1
+	if !hit {
+		done := trackCapture()
+		img, meta, attempts, err = captureBest(r.Context(), opts)
+		done(err)
+		if err != nil {
+			lastCapture.forget(cacheKey)
+			logError(r, err)
+			writeCaptureError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Capture-Timestamp", meta.CapturedAt.UTC().Format(time.RFC3339Nano))
+	w.Header().Set("X-Capture-Duration-Ms", strconv.FormatInt(meta.Duration.Milliseconds(), 10))
+	if !hit && meta.QueueWait > 0 {
+		w.Header().Set("X-Queue-Wait-Ms", strconv.FormatInt(meta.QueueWait.Milliseconds(), 10))
+	}
+	debugCapture(w, r, meta, !hit)
+	if captureCacheTTL > 0 {
+		status := "MISS"
+		if hit {
+			status = "HIT"
+		}
+		// the cache is per device, say whose capture this was
+		cacheDevice := device
+		if cacheDevice == "" {
+			cacheDevice = "default"
+		}
+		w.Header().Set("X-Cache", status+"; device="+cacheDevice)
+	}
+	if opts.liveness() {
+		w.Header().Set("X-Liveness-Score", livenessHeader(meta.Liveness))
+	}
+	if !hit {
+		setQualityHeaders(w, meta, attempts)
+	}
+	if meta.Quality != nil {
+		quality := *meta.Quality
+		w.Header().Set("X-Fingerprint-Quality", strconv.Itoa(quality))
+		if quality < rejectQualityBelow {
+			lastCapture.forget(cacheKey)
+			logError(r, fmt.Errorf("quality %d is below %d", quality, rejectQualityBelow))
+			writeAPIError(w, r, http.StatusUnprocessableEntity, codeLowQuality, fmt.Sprintf("Fingerprint quality %d is below %d, please scan again", quality, rejectQualityBelow))
+			return
+		}
+	}
+	if !hit {
+		// only now, a capture rejected for its quality isn't kept
+		saveCapture(r.Context(), img, meta.CapturedAt, captureFormat)
+		lastCapture.put(cacheKey, img, meta)
+	}
+
+	if hashCaptures && format != "wsq" {
+		if h, err := hashImage(img); err != nil {
+			logFor(r.Context()).Warn("can't hash capture", "error", err.Error())
+		} else {
+			w.Header().Set("X-Image-Hash", h.String())
+			// a cached answer is the same capture again, not a second scan
+			if !hit {
+				if dup := previousCapture.swap(h, requestID(r.Context())); dup != "" {
+					w.Header().Set("X-Duplicate-Of", dup)
+					logFor(r.Context()).Warn("capture looks like the previous one", "event", "capture_duplicate", "duplicate_of", dup)
+				}
+			}
+		}
+	}
+
+	// what capture.py says it scanned at beats what we asked for
+	if meta.Resolution > 0 {
+		resolution = meta.Resolution
+	}
+	if resolution > 0 {
+		w.Header().Set("X-Image-Resolution", strconv.Itoa(resolution))
+		if r.URL.Query().Get("dpi") == "" {
+			dpi = resolution
+		}
+	}
+
+	if !t.none() {
+		var box image.Rectangle
+		if img, box, err = t.apply(img, captureFormat); err != nil {
+			logError(r, err)
+			if errors.Is(err, errCropOutside) {
+				writeAPIError(w, r, http.StatusBadRequest, codeCropOutside, err.Error())
+			} else {
+				writeAPIError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+			}
+			return
+		}
+		if t.autocrop {
+			w.Header().Set("X-Crop-Box", cropBoxHeader(box))
+		}
+	}
+
+	if format == "png" || format == "datauri" {
+		if tagged, err := setPNGDPI(img, dpi); err != nil {
+			logFor(r.Context()).Warn("can't set png dpi, sending it as is", "error", err.Error())
+		} else {
+			img = tagged
+		}
+	}
+	if embedMetadata {
+		if tagged, err := setPNGText(img, captureText(meta, device, dpi, requestID(r.Context()))); err != nil {
+			logFor(r.Context()).Warn("can't embed png metadata, sending it as is", "error", err.Error())
+		} else {
+			img = tagged
+		}
+	}
+	w.Header().Set("X-Image-DPI", strconv.Itoa(dpi))
+
+	body := img
+	if format == "raw" {
+		pix, width, height, err := rawGray(img)
+		if err != nil {
+			logError(r, err)
+			writeAPIError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		setRawHeaders(w.Header(), width, height)
+		body = pix
+	} else if width, height, ok := imageSize(img); ok {
+		setImageSize(w.Header(), width, height)
+	}
+	if format == "datauri" {
+		body = dataURI(img, formats[captureFormat])
+	}
+	if format == "nist" {
+		nist.tcn, nist.device, nist.dpi, nist.at = requestID(r.Context()), device, dpi, meta.CapturedAt
+		if body, err = nistTransaction(img, nist); err != nil {
+			logError(r, err)
+			writeAPIError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+	}
+
+	if dest == "file" {
+		writeCaptureFile(w, r, body, contentType, format)
+	} else {
+		// the ETag is of what we'd send, a new capture only matches when
+		// it's the same bytes
+		etag := bodyETag(body)
+		w.Header().Set("ETag", etag)
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+		} else if _, err = w.Write(body); err != nil {
+			return
+		}
+	}
+	if !hit {
+		sendWebhook(r.Context(), img, meta)
 	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// multipart uploads bigger than this spill to temp files while parsing
+const maxUploadMemory = 10 << 20
+
+// absolute path of the matcher script, resolved once in main
+var matchScriptPath string
+
+type matchResult struct {
+	Match bool    `json:"match"`
+	Score float64 `json:"score"`
+}
+
+// HandleMatch compares the uploaded probe and candidate images with the
+// matcher script, it never touches the sensor
+func HandleMatch(w http.ResponseWriter, r *http.Request) {
+	// a form that fails to parse leaves no temp files behind, whatever it
+	// spilled is removed by ParseMultipartForm itself
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, uploadTooLarge(tooLarge.Limit))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "expected a multipart form with probe and candidate images")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var paths []string
+	defer func() {
+		for _, p := range paths {
+			os.Remove(p)
+		}
+	}()
+	for _, field := range []string{"probe", "candidate"} {
+		f, _, err := r.FormFile(field)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("missing %s image", field))
+			return
+		}
+		path, err := writeTemp(f, field)
+		f.Close()
+		if err != nil {
+			logError(r, err)
+			writeJSONError(w, http.StatusInternalServerError, "can't store uploaded images")
+			return
+		}
+		paths = append(paths, path)
+	}
+
+	out, err := runPython(r.Context(), captureTimeout, matchScriptPath, paths...)
+	if err != nil {
+		logError(r, err)
+		writeScriptError(w, "Matcher", err)
+		return
+	}
+
+	var res matchResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		logError(r, fmt.Errorf("matcher returned invalid json: %w", err))
+		writeJSONError(w, http.StatusInternalServerError, "Matcher returned invalid json")
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// writeScriptError answers with the error of a helper script run by
+// runPython, what names the script for the message
+func writeScriptError(w http.ResponseWriter, what string, err error) {
+	var se *scriptError
+	switch {
+	case errors.As(err, &se):
+		writeJSONError(w, http.StatusInternalServerError, what+" failed: "+se.Stderr)
+	case errors.Is(err, errCaptureTimeout):
+		writeJSONError(w, http.StatusGatewayTimeout, what+" "+err.Error())
+	default:
+		writeJSONError(w, http.StatusInternalServerError, what+" failed: "+err.Error())
+	}
+}
+
+// writeTemp copies r to a temp file for a python script to read and returns
+// its path, the caller removes it
+func writeTemp(r io.Reader, name string) (string, error) {
+	tmp, err := os.CreateTemp("", "fp-"+name+"-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
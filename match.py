@@ -0,0 +1,66 @@
+import sys
+import json
+import argparse
+
+# images are compared at this size, small enough for pure python
+CMP_W, CMP_H = 64, 72
+# how far (in compared pixels) the prints may be shifted against each other
+MAX_SHIFT = 8
+DEFAULT_THRESHOLD = 0.6
+
+
+def log(*args):
+    print(*args, file=sys.stderr)
+
+
+def load(path: str) -> list[float]:
+    from PIL import Image
+
+    with Image.open(path) as img:
+        px = list(img.convert("L").resize((CMP_W, CMP_H)).getdata())
+    mean = sum(px) / len(px)
+    return [p - mean for p in px]
+
+
+def correlation(a: list[float], b: list[float], dx: int, dy: int) -> float:
+    """Normalized cross correlation of the overlap of a and b shifted by dx, dy."""
+    sab = saa = sbb = 0.0
+    for y in range(max(0, dy), min(CMP_H, CMP_H + dy)):
+        for x in range(max(0, dx), min(CMP_W, CMP_W + dx)):
+            pa = a[y * CMP_W + x]
+            pb = b[(y - dy) * CMP_W + (x - dx)]
+            sab += pa * pb
+            saa += pa * pa
+            sbb += pb * pb
+    if saa == 0 or sbb == 0:
+        return 0.0
+    return sab / (saa * sbb) ** 0.5
+
+
+def best_correlation(a: list[float], b: list[float]) -> float:
+    """Best correlation over all shifts up to MAX_SHIFT."""
+    best = 0.0
+    for dy in range(-MAX_SHIFT, MAX_SHIFT + 1, 2):
+        for dx in range(-MAX_SHIFT, MAX_SHIFT + 1, 2):
+            best = max(best, correlation(a, b, dx, dy))
+    return best
+
+
+def score(probe: str, candidate: str) -> float:
+    return best_correlation(load(probe), load(candidate))
+
+
+def main():
+    p = argparse.ArgumentParser(description="Compare two fingerprint images, writes json to stdout")
+    p.add_argument("probe")
+    p.add_argument("candidate")
+    p.add_argument("--threshold", type=float, default=DEFAULT_THRESHOLD)
+    args = p.parse_args()
+
+    s = score(args.probe, args.candidate)
+    log(f"score={s:.3f} threshold={args.threshold}")
+    json.dump({"match": s >= args.threshold, "score": round(s, 3)}, sys.stdout)
+
+
+if __name__ == "__main__":
+    main()
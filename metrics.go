@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	capturesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fingerprint_captures_total",
+		Help: "Captures by outcome, success, error, timeout, busy or aborted.",
+	}, []string{"outcome"})
+
+	captureDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fingerprint_capture_duration_seconds",
+		Help:    "How long a capture took, including the wait for the sensor.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60},
+	})
+
+	capturesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fingerprint_captures_in_flight",
+		Help: "Captures currently running or waiting for the sensor.",
+	})
+
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fingerprint_worker_queue_depth",
+		Help: "Captures waiting for a free capture worker.",
+	})
+
+	workersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fingerprint_workers_busy",
+		Help: "Capture workers serving a capture right now.",
+	})
+
+	workersTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "fingerprint_workers",
+		Help: "Capture workers in the pool, utilization is fingerprint_workers_busy over this.",
+	})
+
+	workerRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "fingerprint_worker_restarts_total",
+		Help: "Times a capture worker was started again after it crashed or got stuck.",
+	})
+)
+
+// trackCapture counts a capture as in flight until the returned func is
+// called with its result
+func trackCapture() func(err error) {
+	now := time.Now()
+	capturesInFlight.Inc()
+	return func(err error) {
+		capturesInFlight.Dec()
+		captureDuration.Observe(time.Since(now).Seconds())
+		capturesTotal.WithLabelValues(captureOutcome(err)).Inc()
+	}
+}
+
+func captureOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, errCaptureTimeout):
+		return "timeout"
+	case errors.Is(err, errSensorBusy), errors.Is(err, errQueueFull):
+		return "busy"
+	case errors.Is(err, errCaptureAborted):
+		return "aborted"
+	case errors.Is(err, errNoFinger):
+		return "no_finger"
+	case errors.Is(err, errSpoofSuspected):
+		return "spoof"
+	case errors.Is(err, errPythonMissing):
+		return "python_missing"
+	}
+	return "error"
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// sample capture served in -mock mode
+//
+//go:embed assets/sample.png
+var samplePNG []byte
+
+// answer captures with samplePNG instead of running capture.py, for working
+// on the server or a frontend without a sensor
+var mockCapture bool
+
+// runMock is what capture.py would have answered to args
+func runMock(args []string) (*captureResult, error) {
+	switch {
+	case slices.Contains(args, "--status"):
+		return &captureResult{Image: []byte(`{"connected":true,"mode":"mock"}`)}, nil
+	case slices.Contains(args, "--finger"):
+		return &captureResult{Image: []byte(`{"present":true}`)}, nil
+	case slices.Contains(args, "--list"):
+		return &captureResult{Image: []byte(`{"devices":[{"id":"mock:0","type":"mock"}]}`)}, nil
+	case slices.Contains(args, "--calibrate"), slices.Contains(args, "--clean"):
+		return &captureResult{Image: []byte(`{"ok":true,"supported":true,"message":"mock sensor"}`)}, nil
+	case slices.Contains(args, "--capabilities"):
+		// the sample is png and never resampled
+		width, height, _ := imageSize(samplePNG)
+		return &captureResult{Image: fmt.Appendf(nil, `{"formats":["png","jpeg","bmp"],"resolutions":[500],"nativeDpi":500,"width":%d,"height":%d,"quality":true,"liveness":true}`, width, height)}, nil
+	}
+
+	img := samplePNG
+	if argValue(args, "--format") == "wsq" {
+		// there's no wsq encoder on this side
+		return nil, fmt.Errorf("%w, -mock can't make wsq", errBadImage)
+	}
+	if format := argValue(args, "--format"); format != "" && format != "png" {
+		var err error
+		if img, _, err = (transform{}).apply(samplePNG, format); err != nil {
+			return nil, err
+		}
+	}
+	stderr := "QUALITY=80"
+	if slices.Contains(args, "--liveness") {
+		stderr += "\nLIVENESS=95"
+	}
+	if argValue(args, "--resolution") != "" {
+		// the sample is 500 dpi and doesn't get resampled
+		stderr += "\nRESOLUTION=500"
+	}
+	return &captureResult{Image: img, Stderr: stderr}, nil
+}
+
+// mockCapturer answers with the embedded sample, for -mock and for running
+// the handlers without a sensor
+type mockCapturer struct{}
+
+func (mockCapturer) Capture(ctx context.Context, opts CaptureOptions) ([]byte, Metadata, error) {
+	at := time.Now()
+	// the steps capture.py reports, for trying /capture/events
+	captureEvent(ctx, `{"step":"waiting_for_finger","message":"Place your finger on the sensor"}`)
+	captureEvent(ctx, `{"step":"finger_detected","message":"Finger detected, hold still"}`)
+	res, err := runMock(opts.args())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return checkCapture(ctx, res, opts, at)
+}
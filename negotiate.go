@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiation order when the client likes several formats just as much
+var formatPreference = []string{"png", "jpeg", "bmp", "wsq", "raw", "nist", "datauri"}
+
+// negotiateFormat picks the capture format for an Accept header. An empty
+// header is png, ok is false when the client accepts none of our formats
+func negotiateFormat(accept string) (format string, ok bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "png", true
+	}
+
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ, subtype, found := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !found {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{typ, subtype, q})
+	}
+
+	best, bestQ := "", 0.0
+	for _, f := range formatPreference {
+		ct, _ := formatContentType(f)
+		typ, subtype, _ := strings.Cut(ct, "/")
+		// the most specific range that matches decides the q
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			s := -1
+			switch {
+			case r.typ == typ && r.subtype == subtype:
+				s = 2
+			case r.typ == typ && r.subtype == "*":
+				s = 1
+			case r.typ == "*" && r.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best, best != ""
+}
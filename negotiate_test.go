@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		format string
+		ok     bool
+	}{
+		{"", "png", true},
+		{"image/png", "png", true},
+		{"image/jpeg", "jpeg", true},
+		{"IMAGE/JPEG", "jpeg", true},
+		{"image/x-wsq", "wsq", true},
+		{"application/octet-stream", "raw", true},
+		{"application/x-ansi-nist", "nist", true},
+		{"text/uri-list", "datauri", true},
+
+		// q ordering
+		{"image/png;q=0.8, image/jpeg", "jpeg", true},
+		{"image/png; q=0.8, image/jpeg; q=0.9", "jpeg", true},
+		{"image/jpeg;q=0.5, image/bmp;q=0.5", "jpeg", true},
+		{"image/bmp, image/jpeg", "jpeg", true},
+
+		// q=0 is "not this one"
+		{"image/png;q=0, image/jpeg", "jpeg", true},
+		{"image/*, image/png;q=0", "jpeg", true},
+		{"*/*, image/png;q=0, image/jpeg;q=0", "bmp", true},
+
+		// wildcards
+		{"*/*", "png", true},
+		{"image/*", "png", true},
+		{"text/html, */*;q=0.1", "png", true},
+		{"application/*", "raw", true},
+		{"*/*;q=0.1, image/bmp", "bmp", true},
+
+		// nothing we can make, the 406
+		{"text/html", "", false},
+		{"image/png;q=0", "", false},
+		{"image/*;q=0, text/html", "", false},
+		{"garbage", "", false},
+	}
+	for _, tt := range tests {
+		format, ok := negotiateFormat(tt.accept)
+		if format != tt.format || ok != tt.ok {
+			t.Errorf("negotiateFormat(%q) = %q, %v, want %q, %v", tt.accept, format, ok, tt.format, tt.ok)
+		}
+	}
+}
+
+func TestHandleCaptureNotAcceptable(t *testing.T) {
+	useCapturer(t, mockCapturer{})
+
+	r := httptest.NewRequest(http.MethodGet, "/capture", nil)
+	r.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	HandleCapture(rec, r)
+	if rec.Code != http.StatusNotAcceptable {
+		t.Errorf("status %d, want 406", rec.Code)
+	}
+
+	// ?format= wins over Accept
+	r = httptest.NewRequest(http.MethodGet, "/capture?format=png", nil)
+	r.Header.Set("Accept", "text/html")
+	rec = httptest.NewRecorder()
+	HandleCapture(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d with ?format=png, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ?format=nist wraps the capture in an ANSI/NIST-ITL 1-2011 transaction: a
+// type 1 header and a type 14 fingerprint record with the pixels
+// uncompressed. capture.py captures a png for it, like for raw
+const nistContentType = "application/x-ansi-nist"
+
+// separators of the tagged fields
+const (
+	nistFS = "\x1c" // ends a record
+	nistGS = "\x1d" // between fields
+	nistRS = "\x1e" // between subfields
+	nistUS = "\x1f" // between the items of a subfield
+)
+
+// what ?tot= is when not given, most receivers want their own
+const defaultNISTTOT = "ENR"
+
+var (
+	validNISTAgency = regexp.MustCompile(`^[A-Za-z0-9]{1,32}$`)
+	validNISTTOT    = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+)
+
+// nistInfo is what goes into the records besides the image
+type nistInfo struct {
+	// type of transaction, destination and originating agency
+	tot, dai, ori string
+	// transaction control number, the request id
+	tcn string
+	// finger position, 0 is unknown, 1-10 thumb to little finger right
+	// hand first
+	finger int
+	device string
+	dpi    int
+	at     time.Time
+}
+
+// parseNISTInfo reads ?tot=, ?dai=, ?ori= and ?finger= from r
+func parseNISTInfo(r *http.Request) (nistInfo, error) {
+	q := r.URL.Query()
+	info := nistInfo{tot: defaultNISTTOT, dai: "NONE", ori: "NONE"}
+	for _, p := range []struct {
+		name  string
+		value *string
+		valid *regexp.Regexp
+	}{
+		{"tot", &info.tot, validNISTTOT},
+		{"dai", &info.dai, validNISTAgency},
+		{"ori", &info.ori, validNISTAgency},
+	} {
+		if v := q.Get(p.name); v != "" {
+			if !p.valid.MatchString(v) {
+				return info, fmt.Errorf("invalid %s %q", p.name, v)
+			}
+			*p.value = strings.ToUpper(v)
+		}
+	}
+	if v := q.Get("finger"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 10 {
+			return info, fmt.Errorf("invalid finger %q, want 0 to 10", v)
+		}
+		info.finger = n
+	}
+	return info, nil
+}
+
+type nistField struct {
+	num   int
+	value string
+}
+
+// nistRecord encodes a tagged record of type typ out of fields, which don't
+// include LEN. LEN comes first and counts the whole record, its own digits
+// too
+func nistRecord(typ int, fields []nistField) []byte {
+	var rest bytes.Buffer
+	for i, f := range fields {
+		fmt.Fprintf(&rest, "%d.%03d:%s", typ, f.num, f.value)
+		// the last field ends the record
+		if i == len(fields)-1 {
+			rest.WriteString(nistFS)
+		} else {
+			rest.WriteString(nistGS)
+		}
+	}
+
+	n := len(fmt.Sprintf("%d.001:", typ)) + len(nistGS) + rest.Len()
+	digits := 1
+	for len(strconv.Itoa(n+digits)) != digits {
+		digits++
+	}
+	var rec bytes.Buffer
+	fmt.Fprintf(&rec, "%d.001:%d%s", typ, n+digits, nistGS)
+	rec.Write(rest.Bytes())
+	return rec.Bytes()
+}
+
+// nistTransaction is img as a type 1 and type 14 transaction. The device goes
+// in user defined field 14.200
+func nistTransaction(img []byte, info nistInfo) ([]byte, error) {
+	pix, width, height, err := rawGray(img)
+	if err != nil {
+		return nil, err
+	}
+	// pixels per mm, NN.NN
+	ppmm := fmt.Sprintf("%05.2f", float64(info.dpi)/25.4)
+	date := info.at.UTC().Format("20060102")
+	dpi := strconv.Itoa(info.dpi)
+
+	out := nistRecord(1, []nistField{
+		{2, "0500"},
+		// this record and one more, a type 14 with IDC 0
+		{3, "1" + nistUS + "1" + nistRS + "14" + nistUS + "0"},
+		{4, info.tot},
+		{5, date},
+		{7, info.dai},
+		{8, info.ori},
+		{9, info.tcn},
+		{11, ppmm},
+		{12, ppmm},
+		{14, info.at.UTC().Format("20060102150405Z")},
+	})
+	fields := []nistField{
+		{2, "0"},
+		// live scan plain
+		{3, "0"},
+		{4, info.ori},
+		{5, date},
+		{6, strconv.Itoa(width)},
+		{7, strconv.Itoa(height)},
+		// pixels per inch
+		{8, "1"},
+		{9, dpi},
+		{10, dpi},
+		{11, "NONE"},
+		{12, "8"},
+		{13, strconv.Itoa(info.finger)},
+	}
+	if info.device != "" {
+		fields = append(fields, nistField{200, info.device})
+	}
+	fields = append(fields, nistField{999, string(pix)})
+	return append(out, nistRecord(14, fields)...), nil
+}
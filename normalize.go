@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+var (
+	// -normalize, stretch the histogram of every capture to the full range
+	normalizeImages bool
+	// -gamma, above 1 brightens, 1 leaves the image as is
+	imageGamma = 1.0
+)
+
+// share of the darkest and brightest pixels the contrast stretch ignores, so
+// a few dead or saturated pixels don't decide the range
+const normalizeClip = 0.01
+
+// levels stretches the contrast of src when normalize is set and applies
+// gamma, through one lookup table. The result is gray, like the sensor
+func levels(src image.Image, normalize bool, gamma float64) *image.Gray {
+	gray, ok := src.(*image.Gray)
+	if !ok {
+		b := src.Bounds()
+		gray = image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(gray, gray.Bounds(), src, b.Min, draw.Src)
+	}
+
+	lo, hi := 0, 255
+	if normalize {
+		lo, hi = histogramRange(gray)
+	}
+
+	var lut [256]uint8
+	for v := range lut {
+		x := 0.0
+		if hi > lo {
+			x = min(max(float64(v-lo)/float64(hi-lo), 0), 1)
+		}
+		if gamma > 0 && gamma != 1 {
+			x = math.Pow(x, 1/gamma)
+		}
+		lut[v] = uint8(math.Round(x * 255))
+	}
+
+	out := image.NewGray(gray.Bounds())
+	for y := gray.Rect.Min.Y; y < gray.Rect.Max.Y; y++ {
+		for x := gray.Rect.Min.X; x < gray.Rect.Max.X; x++ {
+			i := gray.PixOffset(x, y)
+			out.Pix[i] = lut[gray.Pix[i]]
+		}
+	}
+	return out
+}
+
+// histogramRange is the lowest and highest gray value once normalizeClip of
+// the pixels is cut off at both ends
+func histogramRange(img *image.Gray) (lo, hi int) {
+	var hist [256]int
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			hist[img.Pix[img.PixOffset(x, y)]]++
+		}
+	}
+	clip := int(float64(img.Rect.Dx()*img.Rect.Dy()) * normalizeClip)
+
+	lo, hi = 0, 255
+	for n := 0; lo < 255; lo++ {
+		if n += hist[lo]; n > clip {
+			break
+		}
+	}
+	for n := 0; hi > 0; hi-- {
+		if n += hist[hi]; n > clip {
+			break
+		}
+	}
+	if hi <= lo {
+		// a flat image, nothing to stretch
+		return 0, 255
+	}
+	return lo, hi
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// -relative-to-cwd, look for capture.py, the venv and the other scripts in
+// the working directory like before instead of next to the executable
+var relativeToCwd bool
+
+// where relative script and venv paths start from, the executable's
+// directory unless -relative-to-cwd. Empty is the working directory
+var appDir string
+
+// executableDir is the directory of the running binary, through symlinks so
+// a /usr/local/bin link finds the files of the real install
+func executableDir() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = real
+	}
+	return filepath.Dir(exe), nil
+}
+
+// appPath is p under appDir, an absolute p stays as it is
+func appPath(p string) string {
+	if appDir == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(appDir, p)
+}
+
+// findAppDir sets appDir to the executable's directory, unless
+// -relative-to-cwd
+func findAppDir() error {
+	if relativeToCwd {
+		return nil
+	}
+	var err error
+	appDir, err = executableDir()
+	return err
+}
+
+// resolveScriptCwd makes -script-cwd absolute, it has to be a directory
+func resolveScriptCwd() error {
+	if scriptCwd == "" {
+		return nil
+	}
+	var err error
+	if scriptCwd, err = filepath.Abs(scriptCwd); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(scriptCwd); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%s isn't a directory", scriptCwd)
+	}
+	return nil
+}
+
+// resolvePython makes -python absolute, a relative one would be looked up
+// in the script's directory. It's used as is, no falling back to the venv
+// when it's wrong
+func resolvePython() error {
+	var err error
+	if pythonPath, err = absCommand(pythonPath); err != nil {
+		return err
+	}
+	if pythonPath != "" && !mockCapture {
+		if _, err := exec.LookPath(pythonPath); err != nil {
+			return fmt.Errorf("python set with -python isn't executable: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveScript sets scriptPath from -script. embedded is true when it's
+// the default capture.py and it isn't there, the embedded copy stands in
+// then. A script that was asked for by name has to be there
+func resolveScript(cfg Config) (embedded bool, err error) {
+	if scriptPath, err = filepath.Abs(appPath(cfg.Script)); err != nil {
+		return false, err
+	}
+	if mockCapture {
+		return false, nil
+	}
+	if _, err := os.Stat(scriptPath); err != nil {
+		if cfg.Script != pythonScript {
+			return false, fmt.Errorf("capture script not found: %w", err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pngText is one tEXt chunk, keyword and value
+type pngText struct {
+	key, value string
+}
+
+// requestEmbedMetadata is ?metadata=embedded, the capture metadata goes in
+// png text chunks too so it stays with a saved file. headers, the default,
+// only has the X- headers
+func requestEmbedMetadata(r *http.Request) (bool, error) {
+	switch v := r.URL.Query().Get("metadata"); v {
+	case "", "headers":
+		return false, nil
+	case "embedded":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid metadata %q, want headers or embedded", v)
+	}
+}
+
+// captureText is what ?metadata=embedded puts in the png
+func captureText(meta Metadata, device string, dpi int, id string) []pngText {
+	if device == "" {
+		device = "default"
+	}
+	text := []pngText{
+		{"CaptureTime", meta.CapturedAt.UTC().Format(time.RFC3339Nano)},
+		{"Device", device},
+		{"DPI", strconv.Itoa(dpi)},
+	}
+	if meta.Quality != nil {
+		text = append(text, pngText{"Quality", strconv.Itoa(*meta.Quality)})
+	}
+	if meta.Liveness != nil {
+		text = append(text, pngText{"Liveness", strconv.Itoa(*meta.Liveness)})
+	}
+	if id != "" {
+		text = append(text, pngText{"RequestID", id})
+	}
+	return text
+}
+
+// setPNGText puts a tEXt chunk for every entry of text before the first
+// IDAT, tEXt chunks capture.py wrote with the same keywords are dropped.
+// Readers skip chunks they don't know so the image decodes as before. The
+// values are ours and ascii, which tEXt's latin-1 covers
+func setPNGText(img []byte, text []pngText) ([]byte, error) {
+	if !bytes.HasPrefix(img, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+	keys := make(map[string]bool, len(text))
+	for _, t := range text {
+		keys[t.key] = true
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(img)+len(text)*40))
+	out.Write(pngSignature)
+	rest := img[len(pngSignature):]
+	written := false
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, errors.New("truncated png chunk")
+		}
+		size := binary.BigEndian.Uint32(rest)
+		if uint64(size)+12 > uint64(len(rest)) {
+			return nil, errors.New("truncated png chunk")
+		}
+		chunk := rest[:size+12]
+		rest = rest[size+12:]
+
+		switch string(chunk[4:8]) {
+		case "tEXt":
+			if key, _, _ := bytes.Cut(chunk[8:8+size], []byte{0}); keys[string(key)] {
+				continue
+			}
+		case "IDAT", "IEND":
+			if !written {
+				for _, t := range text {
+					writeTEXt(out, t)
+				}
+				written = true
+			}
+		}
+		out.Write(chunk)
+	}
+	return out.Bytes(), nil
+}
+
+func writeTEXt(w *bytes.Buffer, t pngText) {
+	data := make([]byte, 0, 5+len(t.key)+len(t.value))
+	data = append(data, "tEXt"...)
+	data = append(data, t.key...)
+	data = append(data, 0)
+	data = append(data, t.value...)
+
+	binary.Write(w, binary.BigEndian, uint32(len(data)-4))
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(data))
+}
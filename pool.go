@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull     = errors.New("capture queue is full")
+	errUnknownDevice = errors.New("no capture worker for device")
+)
+
+// queueFullError is errQueueFull with how many were waiting, the client gets
+// it as X-Queue-Length
+type queueFullError struct {
+	length int
+}
+
+func (e *queueFullError) Error() string {
+	return fmt.Sprintf("%s, %d waiting", errQueueFull, e.length)
+}
+
+func (e *queueFullError) Is(target error) bool {
+	return target == errQueueFull
+}
+
+// workerPool hands captures to a set of capture workers. A worker serves one
+// capture at a time, captures that find no free worker wait in a queue of
+// queueSize and anything beyond that is turned away
+type workerPool struct {
+	workers   []*captureWorker
+	queueSize int
+
+	mu      sync.Mutex
+	idle    []*captureWorker
+	waiting []*poolWaiter
+}
+
+// poolWaiter is a capture waiting in the queue for a worker that can serve
+// device, "" means any worker
+type poolWaiter struct {
+	device string
+	got    chan *captureWorker
+}
+
+// nil unless -worker is set, then runCapture goes through it instead of
+// starting capture.py itself
+var pool *workerPool
+
+// newWorkerPool makes size workers, or one per device when devices are given
+func newWorkerPool(size int, devices []string, queueSize int) *workerPool {
+	p := &workerPool{queueSize: queueSize}
+	if len(devices) > 0 {
+		for _, d := range devices {
+			p.workers = append(p.workers, &captureWorker{device: d})
+		}
+	} else {
+		for range size {
+			p.workers = append(p.workers, &captureWorker{})
+		}
+	}
+	p.idle = slices.Clone(p.workers)
+	workersTotal.Set(float64(len(p.workers)))
+	return p
+}
+
+// Start starts every worker at boot, one that doesn't start tries again
+// after -worker-backoff
+func (p *workerPool) Start() {
+	for _, w := range p.workers {
+		if err := w.Start(); err != nil {
+			slog.Warn("can't start capture worker, trying again after the backoff", "device", w.device, "error", err.Error())
+		}
+	}
+}
+
+func (p *workerPool) Stop() {
+	for _, w := range p.workers {
+		w.Stop()
+	}
+}
+
+// Idle stops every worker for -idle-timeout, the next capture on one starts
+// it again
+func (p *workerPool) Idle() {
+	for _, w := range p.workers {
+		w.Idle()
+	}
+}
+
+// serves is whether w can capture from device
+func (w *captureWorker) serves(device string) bool {
+	return w.device == "" || device == "" || w.device == device
+}
+
+// acquire gets a worker for device, waiting in the queue while they're all
+// busy. ctx only bounds the wait, like acquireLock, and wait is how long it
+// took
+func (p *workerPool) acquire(ctx context.Context, device string) (_ *captureWorker, wait time.Duration, _ error) {
+	if !slices.ContainsFunc(p.workers, func(w *captureWorker) bool { return w.serves(device) }) {
+		return nil, 0, fmt.Errorf("%w %q", errUnknownDevice, device)
+	}
+
+	p.mu.Lock()
+	// one that's down only when there's nothing else, it fails right away
+	i := slices.IndexFunc(p.idle, func(w *captureWorker) bool { return w.serves(device) && !w.down.Load() })
+	if i < 0 {
+		i = slices.IndexFunc(p.idle, func(w *captureWorker) bool { return w.serves(device) })
+	}
+	if i >= 0 {
+		w := p.idle[i]
+		p.idle = slices.Delete(p.idle, i, i+1)
+		p.mu.Unlock()
+		workersBusy.Inc()
+		return w, 0, nil
+	}
+	if busyMode == busyReject {
+		p.mu.Unlock()
+		return nil, 0, errSensorBusy
+	}
+	if len(p.waiting) >= p.queueSize {
+		length := len(p.waiting)
+		p.mu.Unlock()
+		return nil, 0, &queueFullError{length: length}
+	}
+	wt := &poolWaiter{device: device, got: make(chan *captureWorker, 1)}
+	p.waiting = append(p.waiting, wt)
+	queueDepth.Set(float64(len(p.waiting)))
+	p.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case w := <-wt.got:
+		return w, time.Since(start), nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		p.waiting = slices.DeleteFunc(p.waiting, func(o *poolWaiter) bool { return o == wt })
+		queueDepth.Set(float64(len(p.waiting)))
+		p.mu.Unlock()
+		// a worker may have been handed over right before we left the queue
+		select {
+		case w := <-wt.got:
+			p.release(w)
+		default:
+		}
+		return nil, 0, abortedError(ctx)
+	}
+}
+
+// release gives w to the first queued capture it can serve or marks it idle
+func (p *workerPool) release(w *captureWorker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := slices.IndexFunc(p.waiting, func(o *poolWaiter) bool { return w.serves(o.device) }); i >= 0 {
+		wt := p.waiting[i]
+		p.waiting = slices.Delete(p.waiting, i, i+1)
+		queueDepth.Set(float64(len(p.waiting)))
+		wt.got <- w
+		return
+	}
+	workersBusy.Dec()
+	p.idle = append(p.idle, w)
+}
+
+// capture is runCapture on a pool worker. args are capture.py's flags, a
+// --device in them picks the worker
+func (p *workerPool) capture(ctx context.Context, timeout time.Duration, args []string) (*captureResult, error) {
+	device := argValue(args, "--device")
+	w, wait, err := p.acquire(ctx, device)
+	if err != nil {
+		if errors.Is(err, errSensorBusy) || errors.Is(err, errQueueFull) {
+			logFor(ctx).Warn("no free capture worker, rejecting capture", "device", device, "error", err.Error())
+		}
+		return nil, err
+	}
+	defer p.release(w)
+	if device == "" && w.device != "" {
+		args = append(slices.Clip(args), "--device", w.device)
+	}
+
+	runningCaptures.Add(1)
+	defer runningCaptures.Done()
+
+	ctx, cancel := captureContext(ctx, timeout)
+	defer cancel()
+
+	var res *captureResult
+	err = retryCapture(ctx, func() (bool, error) {
+		var err error
+		res, err = w.capture(ctx, timeout, args)
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Wait = wait
+	return res, nil
+}
+
+// argValue is the value following flag in args, "" when it isn't there
+func argValue(args []string, flag string) string {
+	if i := slices.Index(args, flag); i >= 0 && i+1 < len(args) {
+		return args[i+1]
+	}
+	return ""
+}
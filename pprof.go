@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// servePprof serves the net/http/pprof handlers on addr, -pprof. They get
+// their own listener and no auth, so it's meant for localhost or an ssh
+// tunnel and never the capture port
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("can't listen for pprof", "addr", addr, "error", err.Error())
+	}
+	slog.Warn("serving pprof, don't expose it", "event", "pprof_started", "addr", ln.Addr().String())
+	if err := http.Serve(ln, mux); err != nil {
+		slog.Error("pprof server stopped", "error", err.Error())
+	}
+}
+
+// hidePprof 404s what importing net/http/pprof put on http.DefaultServeMux,
+// the capture port serves that mux and profiles are only for -pprof
+func hidePprof(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
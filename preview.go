@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os/exec"
+	"strconv"
+
+	"github.com/coder/websocket"
+)
+
+// runPreview runs capture.py in preview mode and calls onFrame for every
+// frame until ctx is done or onFrame fails. It holds the sensor lock the
+// whole time so nothing else can capture meanwhile, with -worker it checks
+// out a worker instead and previews its device
+func runPreview(ctx context.Context, format string, onFrame func([]byte) error) error {
+	pythonExec := pythonExecutable()
+	args := []string{"--preview", "--format", format}
+
+	if pool != nil {
+		w, _, err := pool.acquire(ctx, "")
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logFor(ctx).Warn("no free capture worker, rejecting preview", "error", err.Error())
+			return err
+		}
+		defer pool.release(w)
+		if w.device != "" {
+			args = append(args, "--device", w.device)
+		}
+	} else {
+		if _, err := acquireLock(ctx, sensorLock); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			logFor(ctx).Warn("sensor is busy, rejecting preview", "error", err.Error())
+			return errSensorBusy
+		}
+		defer sensorLock.release()
+	}
+	defer useSensor(ctx)()
+
+	runningCaptures.Add(1)
+	defer runningCaptures.Done()
+
+	// the client leaving ends the preview, that's the normal way out
+	pctx, cancel := captureContext(ctx, 0)
+	defer cancel()
+
+	cmd := exec.CommandContext(pctx, pythonExec, append([]string{scriptPath}, withScriptArgs(args)...)...)
+	cmd.Dir = scriptWorkDir(scriptPath)
+	cmd.Env = scriptEnv()
+	var stderrBuf bytes.Buffer
+	cmd.Stderr = &stderrBuf
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return commandError(pctx, 0, err, "", "")
+	}
+
+	frames := bufio.NewReader(stdout)
+	for {
+		frame, err := readFrame(frames)
+		if err != nil {
+			if err != io.EOF && pctx.Err() == nil {
+				logFor(ctx).Error("bad preview frame", "event", "preview_bad_frame", "error", err.Error())
+			}
+			break
+		}
+		if err := onFrame(frame); err != nil {
+			break
+		}
+	}
+	cancel()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil || capturesCtx.Err() != nil {
+		return nil
+	}
+	return commandError(pctx, 0, err, "", stderrBuf.String())
+}
+
+// readFrame reads one length prefixed frame of capture.py's preview mode, a
+// broken script claiming more than maxImageBytes is cut off
+func readFrame(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, errors.New("empty frame")
+	}
+	if int64(size) > int64(maxImageBytes) {
+		return nil, fmt.Errorf("%w, a frame of %d bytes", errImageTooLarge, size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// HandlePreview upgrades to a websocket and sends every preview frame as a
+// binary message until the client goes away
+func HandlePreview(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if _, ok := formats[format]; !ok {
+		http.Error(w, fmt.Sprintf("unsupported format %q, want png, jpeg, bmp or wsq", format), http.StatusBadRequest)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: corsOriginHosts()})
+	if err != nil {
+		// Accept already answered
+		logError(r, err)
+		return
+	}
+	defer c.CloseNow()
+
+	// we never expect messages, but reading is how a close gets noticed
+	ctx := c.CloseRead(r.Context())
+	err = runPreview(ctx, format, func(frame []byte) error {
+		return c.Write(ctx, websocket.MessageBinary, frame)
+	})
+	if err != nil {
+		logError(r, err)
+		code := websocket.StatusInternalError
+		if errors.Is(err, errSensorBusy) || errors.Is(err, errQueueFull) {
+			code = websocket.StatusTryAgainLater
+		}
+		_, msg := captureStatus(err)
+		// close reasons have to fit in a control frame
+		if len(msg) > 120 {
+			msg = msg[:120]
+		}
+		c.Close(code, msg)
+		return
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+}
+
+// HandleMJPEG streams the preview as multipart/x-mixed-replace, so a plain
+// <img src="/stream.mjpeg"> shows the sensor live
+func HandleMJPEG(w http.ResponseWriter, r *http.Request) {
+	mw := multipart.NewWriter(w)
+	rc := http.NewResponseController(w)
+	started := false
+
+	err := runPreview(r.Context(), "jpeg", func(frame []byte) error {
+		if !started {
+			w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+			w.Header().Set("Cache-Control", "no-store")
+			started = true
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   {"image/jpeg"},
+			"Content-Length": {strconv.Itoa(len(frame))},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(frame); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil {
+		logError(r, err)
+		if !started {
+			status, msg := captureStatus(err)
+			http.Error(w, msg, status)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// the most pixels an upload may say it has, checked before it's decoded. A
+// png of a few kilobytes can claim enough to take gigabytes, this is what a
+// resize puts out at most
+const maxProcessPixels = maxResizeDimension * maxResizeDimension
+
+// HandleProcess runs an uploaded image through what /capture does to a
+// capture, ?rotate=, ?crop=, ?autocrop=, ?width=, ?height=, -normalize,
+// -gamma and the DPI tag, without the sensor. The image is the body or the
+// image field of a multipart form, png, jpeg or bmp. ?format= is png, jpeg, bmp, raw or
+// datauri, png by default
+func HandleProcess(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	contentType, ok := formatContentType(format)
+	if !ok || format == "wsq" || format == "nist" {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("unsupported format %q, want png, jpeg, bmp, raw or datauri", format))
+		return
+	}
+	encodeFormat := format
+	if format == "raw" || format == "datauri" {
+		encodeFormat = "png"
+	}
+	t, err := parseTransform(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	dpi, err := requestDPI(r)
+	if err != nil {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+
+	img, err := uploadedImage(w, r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, r, http.StatusRequestEntityTooLarge, codeImageTooLarge, uploadTooLarge(tooLarge.Limit))
+		} else {
+			writeAPIError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		}
+		return
+	}
+	width, height, ok := imageSize(img)
+	if !ok {
+		writeAPIError(w, r, http.StatusBadRequest, codeBadImage, "can't decode the image, want png, jpeg or bmp")
+		return
+	}
+	if int64(width)*int64(height) > maxProcessPixels {
+		writeAPIError(w, r, http.StatusRequestEntityTooLarge, codeImageTooLarge, fmt.Sprintf("the image is %dx%d, at most %d pixels are taken", width, height, maxProcessPixels))
+		return
+	}
+
+	// always applied, a transform that does nothing still converts it to
+	// format
+	img, box, err := t.apply(img, encodeFormat)
+	if err != nil {
+		logError(r, err)
+		if errors.Is(err, errCropOutside) {
+			writeAPIError(w, r, http.StatusBadRequest, codeCropOutside, err.Error())
+		} else {
+			writeAPIError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+		}
+		return
+	}
+	if t.autocrop {
+		w.Header().Set("X-Crop-Box", cropBoxHeader(box))
+	}
+	if encodeFormat == "png" {
+		if img, err = setPNGDPI(img, dpi); err != nil {
+			logError(r, err)
+			writeAPIError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+	}
+	w.Header().Set("X-Image-DPI", strconv.Itoa(dpi))
+
+	body := img
+	switch format {
+	case "raw":
+		pix, width, height, err := rawGray(img)
+		if err != nil {
+			logError(r, err)
+			writeAPIError(w, r, http.StatusInternalServerError, codeInternal, err.Error())
+			return
+		}
+		setRawHeaders(w.Header(), width, height)
+		body = pix
+	case "datauri":
+		body = dataURI(img, formats[encodeFormat])
+	}
+	if format != "raw" {
+		if width, height, ok := imageSize(img); ok {
+			setImageSize(w.Header(), width, height)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// uploadedImage is the request body, or the image field when it's a
+// multipart form. Either is capped at -max-image-bytes
+func uploadedImage(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		img, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxImageBytes)))
+		if err == nil && len(img) == 0 {
+			err = errors.New("no image in the request body")
+		}
+		return img, err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxImageBytes)+maxUploadMemory)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		return nil, errors.New("expected a multipart form with an image field")
+	}
+	defer r.MultipartForm.RemoveAll()
+	f, _, err := r.FormFile("image")
+	if err != nil {
+		return nil, errors.New("missing image field")
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(f, int64(maxImageBytes)+1)); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxImageBytes {
+		return nil, &http.MaxBytesError{Limit: int64(maxImageBytes)}
+	}
+	return buf.Bytes(), nil
+}
+
+// cropBoxHeader is X-Crop-Box, x,y,w,h of what autocrop kept or none
+func cropBoxHeader(box image.Rectangle) string {
+	if box.Empty() {
+		return "none"
+	}
+	return fmt.Sprintf("%d,%d,%d,%d", box.Min.X, box.Min.Y, box.Dx(), box.Dy())
+}
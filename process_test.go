@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// the side worked out from the aspect ratio is capped like the one asked for
+func TestProcessResizeExtremeAspect(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		query         string
+		wantW, wantH  int
+	}{
+		{"wide", 4096, 1, "?height=4096", maxResizeDimension, 4096},
+		{"tall", 1, 4096, "?width=4096", 4096, maxResizeDimension},
+		{"keeps the ratio", 100, 50, "?width=40", 40, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := encodePNG(t, image.NewGray(image.Rect(0, 0, tt.width, tt.height)))
+			rec := httptest.NewRecorder()
+			HandleProcess(rec, httptest.NewRequest(http.MethodPost, "/process"+tt.query, bytes.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+			}
+			cfg, err := png.DecodeConfig(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("size %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+// pngClaiming is a png whose IHDR says width x height, with no pixels after
+// it. Enough for DecodeConfig, a decode would allocate all of it
+func pngClaiming(width, height uint32) []byte {
+	var b bytes.Buffer
+	b.Write(pngSignature)
+	chunk := func(typ string, data []byte) {
+		binary.Write(&b, binary.BigEndian, uint32(len(data)))
+		c := append([]byte(typ), data...)
+		b.Write(c)
+		binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(c))
+	}
+	ihdr := binary.BigEndian.AppendUint32(nil, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	// 8 bit gray
+	ihdr = append(ihdr, 8, 0, 0, 0, 0)
+	chunk("IHDR", ihdr)
+	chunk("IDAT", nil)
+	chunk("IEND", nil)
+	return b.Bytes()
+}
+
+func TestProcessTooManyPixels(t *testing.T) {
+	rec := httptest.NewRecorder()
+	HandleProcess(rec, httptest.NewRequest(http.MethodPost, "/process", bytes.NewReader(pngClaiming(20000, 20000))))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413: %s", rec.Code, rec.Body)
+	}
+	var e apiErrorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Error.Code != codeImageTooLarge {
+		t.Errorf("code %q, want %q", e.Error.Code, codeImageTooLarge)
+	}
+}
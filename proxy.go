@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// -trust-proxy, take the client address from X-Forwarded-For. Only for a
+// server that's reachable through the proxy alone, anyone else could put
+// whatever they like in there
+var trustProxy bool
+
+// clientAddr is the host r came from, without the port. With -trust-proxy
+// it's the last X-Forwarded-For entry, the one the proxy in front of us
+// added, the ones before it came from the client and can be made up
+func clientAddr(r *http.Request) string {
+	if trustProxy {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			hops := strings.Split(xff[len(xff)-1], ",")
+			if last := strings.TrimSpace(hops[len(hops)-1]); last != "" {
+				return last
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// -min-quality, a capture scoring under it is taken again, 0 takes the
+	// first one whatever its score
+	minQuality int
+	// -quality-retries, how many more captures a low score gets
+	qualityRetries = 2
+)
+
+// captureBest is capturer.Capture taken again up to -quality-retries times
+// while capture.py reports a quality under -min-quality. It returns the
+// best one and how many captures were tried, a failing retry counts and
+// ends it with the best so far
+func captureBest(ctx context.Context, opts CaptureOptions) ([]byte, Metadata, int, error) {
+	img, meta, err := capturer.Capture(ctx, opts)
+	if err != nil || minQuality == 0 {
+		return img, meta, 1, err
+	}
+	attempts := 1
+	for attempts <= qualityRetries && meta.Quality != nil && *meta.Quality < minQuality {
+		attempts++
+		logFor(ctx).Info("capture quality is low, capturing again", "event", "capture_quality_retry", "quality", *meta.Quality, "min_quality", minQuality, "attempt", attempts)
+		captureEvent(ctx, fmt.Sprintf(`{"step":"low_quality","message":"Fingerprint quality %d is below %d, please place your finger again"}`, *meta.Quality, minQuality))
+		retryImg, retryMeta, err := capturer.Capture(ctx, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, Metadata{}, attempts, err
+			}
+			logFor(ctx).Warn("quality retry failed, keeping the best capture so far", "event", "capture_quality_retry_failed", "error", err.Error())
+			break
+		}
+		if retryMeta.Quality != nil && *retryMeta.Quality > *meta.Quality {
+			img, meta = retryImg, retryMeta
+		}
+	}
+	return img, meta, attempts, nil
+}
+
+// setQualityHeaders says how many captures it took and, when even the best
+// is under -min-quality, warns with the 422 /capture would answer for
+// -reject-quality-below. The image is sent anyway
+func setQualityHeaders(w http.ResponseWriter, meta Metadata, attempts int) {
+	if minQuality == 0 {
+		return
+	}
+	w.Header().Set("X-Capture-Attempts", strconv.Itoa(attempts))
+	if meta.Quality != nil && *meta.Quality < minQuality {
+		w.Header().Set("X-Quality-Warning", fmt.Sprintf("422 %s quality %d is below %d after %d captures", codeLowQuality, *meta.Quality, minQuality, attempts))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/time/rate"
+)
+
+// one limiter for everyone since there's only one sensor, nil when -rate is 0
+var captureLimiter *rate.Limiter
+
+func setupRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		return
+	}
+	captureLimiter = rate.NewLimiter(rate.Limit(perSecond), max(burst, 1))
+}
+
+// rateLimitMiddleWare answers 429 with a Retry-After once captures come in
+// faster than -rate allows
+func rateLimitMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if captureLimiter != nil {
+			res := captureLimiter.Reserve()
+			if delay := res.Delay(); delay > 0 {
+				res.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				http.Error(w, "Too many captures, slow down", http.StatusTooManyRequests)
+				return
+			}
+		}
+		callback(w, r)
+	}
+}
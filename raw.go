@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"net/http"
+	"strconv"
+)
+
+// ?format=raw isn't something capture.py knows, it captures a png and we
+// send its pixels
+const rawContentType = "application/octet-stream"
+
+// formatContentType is formats plus raw, nist and datauri
+func formatContentType(format string) (string, bool) {
+	switch format {
+	case "raw":
+		return rawContentType, true
+	case "nist":
+		return nistContentType, true
+	case "datauri":
+		return dataURIContentType, true
+	}
+	ct, ok := formats[format]
+	return ct, ok
+}
+
+// rawGray decodes img and returns its pixels as 8 bit gray, row by row
+// without padding
+func rawGray(img []byte) (pix []byte, width, height int, err error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("can't decode capture: %w", err)
+	}
+	b := src.Bounds()
+	gray, ok := src.(*image.Gray)
+	if !ok || gray.Stride != b.Dx() {
+		gray = image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(gray, gray.Bounds(), src, b.Min, draw.Src)
+	}
+	return gray.Pix, b.Dx(), b.Dy(), nil
+}
+
+// setRawHeaders describes the layout of a raw answer
+func setRawHeaders(h http.Header, width, height int) {
+	setImageSize(h, width, height)
+	h.Set("X-Image-Depth", "8")
+}
+
+// imageSize reads the dimensions from img's header, ok is false for what
+// doesn't decode, like wsq
+func imageSize(img []byte) (width, height int, ok bool) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+func setImageSize(h http.Header, width, height int) {
+	h.Set("X-Image-Width", strconv.Itoa(width))
+	h.Set("X-Image-Height", strconv.Itoa(height))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how many captures /admin/recent remembers
+const recentSize = 100
+
+// the logRequest events that end up in /admin/recent
+var recentEvents = map[string]bool{
+	"capture":        true,
+	"capture_json":   true,
+	"capture_batch":  true,
+	"capture_events": true,
+	"enroll":         true,
+	"check_recent":   true,
+	"verify":         true,
+}
+
+type recentCapture struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	RequestID  string    `json:"requestId"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"durationMs"`
+	// ok or failed, anything 400 and up failed
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// recentLog is a ring of the last recentSize captures
+type recentLog struct {
+	mu      sync.Mutex
+	entries []recentCapture
+	next    int
+}
+
+var recent recentLog
+
+func (l *recentLog) add(c recentCapture) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < recentSize {
+		l.entries = append(l.entries, c)
+		return
+	}
+	l.entries[l.next] = c
+	l.next = (l.next + 1) % recentSize
+}
+
+// last is up to n entries, newest first
+func (l *recentLog) last(n int) []recentCapture {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]recentCapture, 0, min(n, len(l.entries)))
+	for i := 0; i < len(l.entries) && len(out) < n; i++ {
+		// next is the oldest one once the ring is full, so next-1 is the newest
+		out = append(out, l.entries[(l.next-1-i+2*len(l.entries))%len(l.entries)])
+	}
+	return out
+}
+
+// recordRequest adds a finished request to recent if it was a capture
+func recordRequest(event, id string, start time.Time, status int, err error) {
+	if !recentEvents[event] {
+		return
+	}
+	c := recentCapture{
+		Time:       start.UTC(),
+		Event:      event,
+		RequestID:  id,
+		Status:     status,
+		DurationMs: time.Since(start).Milliseconds(),
+		Outcome:    "ok",
+	}
+	if status >= 400 {
+		c.Outcome = "failed"
+	}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	recent.add(c)
+}
+
+// HandleRecent lists the last captures, newest first, ?limit= returns fewer
+func HandleRecent(w http.ResponseWriter, r *http.Request) {
+	limit := recentSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid limit %q", v))
+			return
+		}
+		limit = min(n, recentSize)
+	}
+	writeJSON(w, http.StatusOK, map[string][]recentCapture{"captures": recent.last(limit)})
+}
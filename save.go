@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file names sort by capture time, no colons so they work on windows too
+const saveTimeFormat = "20060102-150405.000000000"
+
+var (
+	// every capture is also written here when set
+	saveDir string
+	// prune saveDir to this many captures, 0 keeps everything
+	saveKeep int
+	// one save at a time so pruning doesn't race itself
+	saveMu sync.Mutex
+)
+
+// saveCapture writes img to saveDir in the background, encrypted with
+// -save-encrypt-key when set. The client already has the image so a failed
+// write just gets logged
+func saveCapture(ctx context.Context, img []byte, at time.Time, ext string) {
+	if saveDir == "" {
+		return
+	}
+	go func() {
+		saveMu.Lock()
+		defer saveMu.Unlock()
+
+		path := filepath.Join(saveDir, at.UTC().Format(saveTimeFormat)+"."+ext)
+		if saveKey != nil {
+			var err error
+			if img, err = encryptCapture(saveKey, img); err != nil {
+				logFor(ctx).Error("failed to encrypt capture, not saving it", "event", "capture_save_failed", "error", err.Error())
+				return
+			}
+			path += encryptedExt
+		}
+		if err := os.WriteFile(path, img, 0o600); err != nil {
+			logFor(ctx).Error("failed to save capture", "event", "capture_save_failed", "path", path, "error", err.Error())
+			return
+		}
+		logFor(ctx).Info("saved capture", "event", "capture_saved", "path", path)
+		pruneSaved()
+	}()
+}
+
+// pruneSaved removes the oldest captures beyond saveKeep
+func pruneSaved() {
+	if saveKeep <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(saveDir)
+	if err != nil {
+		slog.Error("failed to list saved captures", "error", err.Error())
+		return
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && isSavedCapture(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) <= saveKeep {
+		return
+	}
+	slices.Sort(names)
+	for _, name := range names[:len(names)-saveKeep] {
+		if err := os.Remove(filepath.Join(saveDir, name)); err != nil {
+			slog.Error("failed to prune saved capture", "name", name, "error", err.Error())
+		}
+	}
+}
+
+// isSavedCapture tells our captures apart from anything else in saveDir
+func isSavedCapture(name string) bool {
+	stamp, _, ok := strings.Cut(name, ".")
+	if !ok {
+		return false
+	}
+	_, err := time.Parse("20060102-150405", stamp)
+	return err == nil
+}
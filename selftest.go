@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// what -selftest does with a failure
+const (
+	selfTestLog   = "log"
+	selfTestFatal = "fatal"
+)
+
+// selfTestMode normalizes a -selftest value, "" is off. A bare -selftest or
+// true only logs
+func selfTestMode(v string) (string, error) {
+	switch v {
+	case "", "false", "off":
+		return "", nil
+	case "true", selfTestLog:
+		return selfTestLog, nil
+	case selfTestFatal:
+		return selfTestFatal, nil
+	}
+	return "", fmt.Errorf("invalid selftest %q, want %q or %q", v, selfTestLog, selfTestFatal)
+}
+
+// selfTestFlag is -selftest, it works as a switch and as -selftest=fatal
+type selfTestFlag struct {
+	mode *string
+}
+
+func (f selfTestFlag) String() string {
+	if f.mode == nil {
+		return ""
+	}
+	return *f.mode
+}
+
+func (f selfTestFlag) Set(v string) error {
+	mode, err := selfTestMode(v)
+	if err != nil {
+		return err
+	}
+	*f.mode = mode
+	return nil
+}
+
+func (f selfTestFlag) IsBoolFlag() bool { return true }
+
+// selfTest runs capture.py --status the way a capture would run, through
+// the workers or under the sensor lock with -script-args and -env, and
+// fails unless a sensor answers. A real capture would need a finger on the
+// sensor while the server starts
+func selfTest(ctx context.Context) error {
+	start := time.Now()
+	st, err := checkSensor(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("self test passed", "event", "selftest_ok", "mode", st.Mode, "model", st.Model, "took", time.Since(start).String())
+	return nil
+}
+
+// runSelfTest is selfTest with what mode says to do when it fails
+func runSelfTest(ctx context.Context, mode string) {
+	if err := selfTest(ctx); err != nil {
+		if mode == selfTestFatal {
+			fatal("self test failed", "event", "selftest_failed", "error", err.Error())
+		}
+		slog.Error("self test failed, serving anyway", "event", "selftest_failed", "error", err.Error())
+	}
+}
+
+// checkSensor is capture.py --status, an error unless a sensor is connected
+func checkSensor(ctx context.Context) (sensorStatus, error) {
+	var st sensorStatus
+	res, err := runCapture(ctx, sensorStatusTimeout, "--status")
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(res.Image, &st); err != nil {
+		return st, fmt.Errorf("capture script returned invalid status json: %w", err)
+	}
+	if !st.Connected {
+		return st, errors.New("capture script ran but found no sensor")
+	}
+	return st, nil
+}
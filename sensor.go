@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// what a capture does when the sensor is already busy
+const (
+	busyWait   = "wait"
+	busyReject = "reject"
+)
+
+// sensorMutex is the lock of one sensor, it can only do one capture at a
+// time. A channel instead of a sync.Mutex so we can try to grab it without
+// blocking, and it counts who's waiting for -max-queue
+type sensorMutex struct {
+	ch      chan struct{}
+	waiting atomic.Int32
+}
+
+func newSensorMutex() *sensorMutex {
+	return &sensorMutex{ch: make(chan struct{}, 1)}
+}
+
+func (m *sensorMutex) release() {
+	<-m.ch
+}
+
+var sensorLock = newSensorMutex()
+
+var busyMode = busyWait
+
+// -max-queue, captures that may wait for a busy sensor, more get a 503. 0 is
+// no limit. -worker has -queue-size instead
+var maxQueue int
+
+// device ids go to capture.py as an argument, keep them to something sane
+var validDeviceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9:._-]{0,31}$`)
+
+// requestDevice is ?device=, "" means whichever sensor capture.py finds
+// first
+func requestDevice(r *http.Request) (string, error) {
+	device := r.URL.Query().Get("device")
+	if device != "" && !validDeviceID.MatchString(device) {
+		return "", fmt.Errorf("invalid device id %q", device)
+	}
+	return device, nil
+}
+
+// deviceArgs is requestDevice as capture.py arguments
+func deviceArgs(r *http.Request) ([]string, error) {
+	device, err := requestDevice(r)
+	if err != nil || device == "" {
+		return nil, err
+	}
+	return []string{"--device", device}, nil
+}
+
+func validBusyMode(mode string) error {
+	switch mode {
+	case busyWait, busyReject:
+		return nil
+	}
+	return fmt.Errorf("invalid busy mode %q, want %q or %q", mode, busyWait, busyReject)
+}
+
+// acquireLock takes lock, backends have their own. In reject mode it gives
+// up right away with errSensorBusy when someone else has it, otherwise it
+// waits in line unless more than maxQueue are waiting already. wait is how
+// long it took, 0 when the sensor was free. ctx ending first is its error
+func acquireLock(ctx context.Context, lock *sensorMutex) (wait time.Duration, err error) {
+	select {
+	case lock.ch <- struct{}{}:
+		return 0, nil
+	default:
+	}
+	if busyMode == busyReject {
+		return 0, errSensorBusy
+	}
+
+	queued := int(lock.waiting.Add(1))
+	defer lock.waiting.Add(-1)
+	if maxQueue > 0 && queued > maxQueue {
+		return 0, &queueFullError{length: queued - 1}
+	}
+	start := time.Now()
+	select {
+	case lock.ch <- struct{}{}:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// status checks talk to the sensor but shouldn't take long
+const sensorStatusTimeout = 10 * time.Second
+
+type sensorStatus struct {
+	Connected bool   `json:"connected"`
+	Mode      string `json:"mode,omitempty"`
+	Model     string `json:"model,omitempty"`
+	Firmware  string `json:"firmware,omitempty"`
+	// why we couldn't even ask, the sensor may still be there
+	Error string `json:"error,omitempty"`
+	// with -idle-timeout, active or idle
+	State string `json:"state,omitempty"`
+}
+
+// the last status capture.py gave, what /sensor/status says while the sensor
+// is idle so polling it doesn't wake it up
+var lastSensorStatus atomic.Pointer[sensorStatus]
+
+// HandleSensorStatus asks capture.py whether a sensor is connected. It's
+// always a 200 so UIs can just poll it
+func HandleSensorStatus(w http.ResponseWriter, r *http.Request) {
+	args, err := deviceArgs(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sensorState() == "idle" {
+		var st sensorStatus
+		if last := lastSensorStatus.Load(); last != nil {
+			st = *last
+		}
+		st.State = "idle"
+		writeJSON(w, http.StatusOK, st)
+		return
+	}
+	st := querySensorStatus(r, args)
+	st.State = sensorState()
+	writeJSON(w, http.StatusOK, st)
+}
+
+func querySensorStatus(r *http.Request, args []string) sensorStatus {
+	res, err := runCapture(r.Context(), sensorStatusTimeout, append([]string{"--status"}, args...)...)
+	if err != nil {
+		logError(r, err)
+		_, msg := captureStatus(err)
+		return sensorStatus{Error: msg}
+	}
+
+	var st sensorStatus
+	if err := json.Unmarshal(res.Image, &st); err != nil {
+		logError(r, err)
+		return sensorStatus{Error: "capture script returned invalid status json"}
+	}
+	lastSensorStatus.Store(&st)
+	return st
+}
+
+// HandleSensorFinger asks capture.py whether a finger is on the sensor, a
+// lot cheaper than a capture so kiosks can poll it and capture once it's
+// true. It waits for the sensor lock like a capture
+func HandleSensorFinger(w http.ResponseWriter, r *http.Request) {
+	args, err := deviceArgs(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res, err := runCapture(r.Context(), sensorStatusTimeout, append([]string{"--finger"}, args...)...)
+	if err != nil {
+		logError(r, err)
+		status, msg := captureStatus(err)
+		writeJSONError(w, status, msg)
+		return
+	}
+
+	var finger struct {
+		Present bool `json:"present"`
+	}
+	if err := json.Unmarshal(res.Image, &finger); err != nil {
+		logError(r, err)
+		writeJSONError(w, http.StatusInternalServerError, "capture script returned invalid finger json")
+		return
+	}
+	writeJSON(w, http.StatusOK, finger)
+}
+
+type sensorList struct {
+	Devices []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	} `json:"devices"`
+}
+
+// HandleSensorList lists the sensors capture.py can see, the ids work as
+// ?device= on the capture endpoints
+func HandleSensorList(w http.ResponseWriter, r *http.Request) {
+	res, err := runCapture(r.Context(), sensorStatusTimeout, "--list")
+	if err != nil {
+		logError(r, err)
+		status, msg := captureStatus(err)
+		writeJSONError(w, status, msg)
+		return
+	}
+
+	var list sensorList
+	if err := json.Unmarshal(res.Image, &list); err != nil {
+		logError(r, err)
+		writeJSONError(w, http.StatusInternalServerError, "capture script returned an invalid device list")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// calibration can take a while on sensors that have one
+const sensorMaintenanceTimeout = time.Minute
+
+// sensorMaintenance is what capture.py --calibrate and --clean answer
+type sensorMaintenance struct {
+	Routine   string `json:"routine"`
+	OK        bool   `json:"ok"`
+	Supported bool   `json:"supported"`
+	Message   string `json:"message,omitempty"`
+}
+
+// HandleSensorMaintenance runs capture.py --<routine>, calibrate or clean. It
+// waits for the sensor lock like a capture. A routine that ran is a 200 with
+// "ok" saying how it went, one the sensor doesn't have is a 501
+func HandleSensorMaintenance(routine string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		args, err := deviceArgs(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		res, err := runCapture(r.Context(), sensorMaintenanceTimeout, append([]string{"--" + routine}, args...)...)
+		if err != nil {
+			logError(r, err)
+			status, msg := captureStatus(err)
+			writeJSONError(w, status, msg)
+			return
+		}
+
+		var result sensorMaintenance
+		if err := json.Unmarshal(res.Image, &result); err != nil {
+			logError(r, err)
+			writeJSONError(w, http.StatusInternalServerError, "capture script returned invalid "+routine+" json")
+			return
+		}
+		result.Routine = routine
+		if !result.Supported {
+			writeJSON(w, http.StatusNotImplemented, result)
+			return
+		}
+		if !result.OK {
+			logFor(r.Context()).Warn("sensor maintenance failed", "event", "sensor_maintenance_failed", "routine", routine, "message", result.Message)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
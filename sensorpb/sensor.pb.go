@@ -0,0 +1,350 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: sensorpb/sensor.proto
+
+package sensorpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CaptureRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Format        string                 `protobuf:"bytes,1,opt,name=format,proto3" json:"format,omitempty"`
+	Device        string                 `protobuf:"bytes,2,opt,name=device,proto3" json:"device,omitempty"`
+	TimeoutMs     uint32                 `protobuf:"varint,3,opt,name=timeout_ms,json=timeoutMs,proto3" json:"timeout_ms,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CaptureRequest) Reset() {
+	*x = CaptureRequest{}
+	mi := &file_sensorpb_sensor_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureRequest) ProtoMessage() {}
+
+func (x *CaptureRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sensorpb_sensor_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureRequest.ProtoReflect.Descriptor instead.
+func (*CaptureRequest) Descriptor() ([]byte, []int) {
+	return file_sensorpb_sensor_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CaptureRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *CaptureRequest) GetDevice() string {
+	if x != nil {
+		return x.Device
+	}
+	return ""
+}
+
+func (x *CaptureRequest) GetTimeoutMs() uint32 {
+	if x != nil {
+		return x.TimeoutMs
+	}
+	return 0
+}
+
+type CaptureResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Image         []byte                 `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	Format        string                 `protobuf:"bytes,2,opt,name=format,proto3" json:"format,omitempty"`
+	ContentType   string                 `protobuf:"bytes,3,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	Quality       *int32                 `protobuf:"varint,4,opt,name=quality,proto3,oneof" json:"quality,omitempty"`
+	Dpi           int32                  `protobuf:"varint,5,opt,name=dpi,proto3" json:"dpi,omitempty"`
+	CapturedAt    *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=captured_at,json=capturedAt,proto3" json:"captured_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CaptureResponse) Reset() {
+	*x = CaptureResponse{}
+	mi := &file_sensorpb_sensor_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CaptureResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CaptureResponse) ProtoMessage() {}
+
+func (x *CaptureResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_sensorpb_sensor_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CaptureResponse.ProtoReflect.Descriptor instead.
+func (*CaptureResponse) Descriptor() ([]byte, []int) {
+	return file_sensorpb_sensor_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CaptureResponse) GetImage() []byte {
+	if x != nil {
+		return x.Image
+	}
+	return nil
+}
+
+func (x *CaptureResponse) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+func (x *CaptureResponse) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+func (x *CaptureResponse) GetQuality() int32 {
+	if x != nil && x.Quality != nil {
+		return *x.Quality
+	}
+	return 0
+}
+
+func (x *CaptureResponse) GetDpi() int32 {
+	if x != nil {
+		return x.Dpi
+	}
+	return 0
+}
+
+func (x *CaptureResponse) GetCapturedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CapturedAt
+	}
+	return nil
+}
+
+type PreviewRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Format        string                 `protobuf:"bytes,1,opt,name=format,proto3" json:"format,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PreviewRequest) Reset() {
+	*x = PreviewRequest{}
+	mi := &file_sensorpb_sensor_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PreviewRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PreviewRequest) ProtoMessage() {}
+
+func (x *PreviewRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_sensorpb_sensor_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PreviewRequest.ProtoReflect.Descriptor instead.
+func (*PreviewRequest) Descriptor() ([]byte, []int) {
+	return file_sensorpb_sensor_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *PreviewRequest) GetFormat() string {
+	if x != nil {
+		return x.Format
+	}
+	return ""
+}
+
+type PreviewFrame struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Image         []byte                 `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	ContentType   string                 `protobuf:"bytes,2,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PreviewFrame) Reset() {
+	*x = PreviewFrame{}
+	mi := &file_sensorpb_sensor_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PreviewFrame) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PreviewFrame) ProtoMessage() {}
+
+func (x *PreviewFrame) ProtoReflect() protoreflect.Message {
+	mi := &file_sensorpb_sensor_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PreviewFrame.ProtoReflect.Descriptor instead.
+func (*PreviewFrame) Descriptor() ([]byte, []int) {
+	return file_sensorpb_sensor_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *PreviewFrame) GetImage() []byte {
+	if x != nil {
+		return x.Image
+	}
+	return nil
+}
+
+func (x *PreviewFrame) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+var File_sensorpb_sensor_proto protoreflect.FileDescriptor
+
+const file_sensorpb_sensor_proto_rawDesc = "" +
+	"\n" +
+	"\x15sensorpb/sensor.proto\x12\x0efingerprint.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"_\n" +
+	"\x0eCaptureRequest\x12\x16\n" +
+	"\x06format\x18\x01 \x01(\tR\x06format\x12\x16\n" +
+	"\x06device\x18\x02 \x01(\tR\x06device\x12\x1d\n" +
+	"\n" +
+	"timeout_ms\x18\x03 \x01(\rR\ttimeoutMs\"\xdc\x01\n" +
+	"\x0fCaptureResponse\x12\x14\n" +
+	"\x05image\x18\x01 \x01(\fR\x05image\x12\x16\n" +
+	"\x06format\x18\x02 \x01(\tR\x06format\x12!\n" +
+	"\fcontent_type\x18\x03 \x01(\tR\vcontentType\x12\x1d\n" +
+	"\aquality\x18\x04 \x01(\x05H\x00R\aquality\x88\x01\x01\x12\x10\n" +
+	"\x03dpi\x18\x05 \x01(\x05R\x03dpi\x12;\n" +
+	"\vcaptured_at\x18\x06 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"capturedAtB\n" +
+	"\n" +
+	"\b_quality\"(\n" +
+	"\x0ePreviewRequest\x12\x16\n" +
+	"\x06format\x18\x01 \x01(\tR\x06format\"G\n" +
+	"\fPreviewFrame\x12\x14\n" +
+	"\x05image\x18\x01 \x01(\fR\x05image\x12!\n" +
+	"\fcontent_type\x18\x02 \x01(\tR\vcontentType2\x9f\x01\n" +
+	"\x06Sensor\x12J\n" +
+	"\aCapture\x12\x1e.fingerprint.v1.CaptureRequest\x1a\x1f.fingerprint.v1.CaptureResponse\x12I\n" +
+	"\aPreview\x12\x1e.fingerprint.v1.PreviewRequest\x1a\x1c.fingerprint.v1.PreviewFrame0\x01B\x11Z\x0fsensor/sensorpbb\x06proto3"
+
+var (
+	file_sensorpb_sensor_proto_rawDescOnce sync.Once
+	file_sensorpb_sensor_proto_rawDescData []byte
+)
+
+func file_sensorpb_sensor_proto_rawDescGZIP() []byte {
+	file_sensorpb_sensor_proto_rawDescOnce.Do(func() {
+		file_sensorpb_sensor_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_sensorpb_sensor_proto_rawDesc), len(file_sensorpb_sensor_proto_rawDesc)))
+	})
+	return file_sensorpb_sensor_proto_rawDescData
+}
+
+var file_sensorpb_sensor_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_sensorpb_sensor_proto_goTypes = []any{
+	(*CaptureRequest)(nil),        // 0: fingerprint.v1.CaptureRequest
+	(*CaptureResponse)(nil),       // 1: fingerprint.v1.CaptureResponse
+	(*PreviewRequest)(nil),        // 2: fingerprint.v1.PreviewRequest
+	(*PreviewFrame)(nil),          // 3: fingerprint.v1.PreviewFrame
+	(*timestamppb.Timestamp)(nil), // 4: google.protobuf.Timestamp
+}
+var file_sensorpb_sensor_proto_depIdxs = []int32{
+	4, // 0: fingerprint.v1.CaptureResponse.captured_at:type_name -> google.protobuf.Timestamp
+	0, // 1: fingerprint.v1.Sensor.Capture:input_type -> fingerprint.v1.CaptureRequest
+	2, // 2: fingerprint.v1.Sensor.Preview:input_type -> fingerprint.v1.PreviewRequest
+	1, // 3: fingerprint.v1.Sensor.Capture:output_type -> fingerprint.v1.CaptureResponse
+	3, // 4: fingerprint.v1.Sensor.Preview:output_type -> fingerprint.v1.PreviewFrame
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_sensorpb_sensor_proto_init() }
+func file_sensorpb_sensor_proto_init() {
+	if File_sensorpb_sensor_proto != nil {
+		return
+	}
+	file_sensorpb_sensor_proto_msgTypes[1].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_sensorpb_sensor_proto_rawDesc), len(file_sensorpb_sensor_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_sensorpb_sensor_proto_goTypes,
+		DependencyIndexes: file_sensorpb_sensor_proto_depIdxs,
+		MessageInfos:      file_sensorpb_sensor_proto_msgTypes,
+	}.Build()
+	File_sensorpb_sensor_proto = out.File
+	file_sensorpb_sensor_proto_goTypes = nil
+	file_sensorpb_sensor_proto_depIdxs = nil
+}
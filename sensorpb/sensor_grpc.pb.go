@@ -0,0 +1,163 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: sensorpb/sensor.proto
+
+package sensorpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Sensor_Capture_FullMethodName = "/fingerprint.v1.Sensor/Capture"
+	Sensor_Preview_FullMethodName = "/fingerprint.v1.Sensor/Preview"
+)
+
+// SensorClient is the client API for Sensor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SensorClient interface {
+	Capture(ctx context.Context, in *CaptureRequest, opts ...grpc.CallOption) (*CaptureResponse, error)
+	Preview(ctx context.Context, in *PreviewRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PreviewFrame], error)
+}
+
+type sensorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSensorClient(cc grpc.ClientConnInterface) SensorClient {
+	return &sensorClient{cc}
+}
+
+func (c *sensorClient) Capture(ctx context.Context, in *CaptureRequest, opts ...grpc.CallOption) (*CaptureResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CaptureResponse)
+	err := c.cc.Invoke(ctx, Sensor_Capture_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *sensorClient) Preview(ctx context.Context, in *PreviewRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PreviewFrame], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Sensor_ServiceDesc.Streams[0], Sensor_Preview_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[PreviewRequest, PreviewFrame]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Sensor_PreviewClient = grpc.ServerStreamingClient[PreviewFrame]
+
+// SensorServer is the server API for Sensor service.
+// All implementations must embed UnimplementedSensorServer
+// for forward compatibility.
+type SensorServer interface {
+	Capture(context.Context, *CaptureRequest) (*CaptureResponse, error)
+	Preview(*PreviewRequest, grpc.ServerStreamingServer[PreviewFrame]) error
+	mustEmbedUnimplementedSensorServer()
+}
+
+// UnimplementedSensorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedSensorServer struct{}
+
+func (UnimplementedSensorServer) Capture(context.Context, *CaptureRequest) (*CaptureResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capture not implemented")
+}
+func (UnimplementedSensorServer) Preview(*PreviewRequest, grpc.ServerStreamingServer[PreviewFrame]) error {
+	return status.Errorf(codes.Unimplemented, "method Preview not implemented")
+}
+func (UnimplementedSensorServer) mustEmbedUnimplementedSensorServer() {}
+func (UnimplementedSensorServer) testEmbeddedByValue()                {}
+
+// UnsafeSensorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SensorServer will
+// result in compilation errors.
+type UnsafeSensorServer interface {
+	mustEmbedUnimplementedSensorServer()
+}
+
+func RegisterSensorServer(s grpc.ServiceRegistrar, srv SensorServer) {
+	// If the following call pancis, it indicates UnimplementedSensorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Sensor_ServiceDesc, srv)
+}
+
+func _Sensor_Capture_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CaptureRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SensorServer).Capture(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Sensor_Capture_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SensorServer).Capture(ctx, req.(*CaptureRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Sensor_Preview_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PreviewRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SensorServer).Preview(m, &grpc.GenericServerStream[PreviewRequest, PreviewFrame]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Sensor_PreviewServer = grpc.ServerStreamingServer[PreviewFrame]
+
+// Sensor_ServiceDesc is the grpc.ServiceDesc for Sensor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Sensor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fingerprint.v1.Sensor",
+	HandlerType: (*SensorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Capture",
+			Handler:    _Sensor_Capture_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Preview",
+			Handler:       _Sensor_Preview_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "sensorpb/sensor.proto",
+}
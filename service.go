@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadImage = errors.New("capture script didn't write the requested image")
+
+// CaptureOptions is what a capture asks for, the zero value is a png from
+// the first sensor found within -timeout
+type CaptureOptions struct {
+	// png, jpeg, bmp or wsq, "" is png
+	Format string
+	// usb:<n> or com:<port>, "" is whatever capture.py finds first
+	Device string
+	// dpi, 0 is capture.py's default
+	Resolution int
+	// 0 is -timeout
+	Timeout time.Duration
+	// one of the config file's backends, "" is -script
+	Backend string
+	// ask capture.py for a liveness score, always on with
+	// -liveness-reject-below
+	Liveness bool
+}
+
+func (o CaptureOptions) liveness() bool {
+	return o.Liveness || livenessRejectBelow > 0
+}
+
+func (o CaptureOptions) format() string {
+	if o.Format == "" {
+		return "png"
+	}
+	return o.Format
+}
+
+func (o CaptureOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return captureTimeout
+	}
+	return o.Timeout
+}
+
+// args are the capture.py flags for o
+func (o CaptureOptions) args() []string {
+	args := []string{"--format", o.format()}
+	if o.Device != "" {
+		args = append(args, "--device", o.Device)
+	}
+	if o.Resolution > 0 {
+		args = append(args, "--resolution", strconv.Itoa(o.Resolution))
+	}
+	if o.liveness() {
+		args = append(args, "--liveness")
+	}
+	return args
+}
+
+// key tells captures apart for the cache, the timeout doesn't matter
+func (o CaptureOptions) key() string {
+	return strings.TrimSpace(o.Backend + " " + strings.Join(o.args(), " "))
+}
+
+// Metadata is what's known about a capture besides the image
+type Metadata struct {
+	Format      string
+	ContentType string
+	CapturedAt  time.Time
+	// how long the capture took, waiting for the sensor included
+	Duration time.Duration
+	// how long of that it waited for a busy sensor, 0 when it was free
+	QueueWait time.Duration
+	// 0-100, nil when capture.py didn't report one
+	Quality *int
+	// 0-100, nil when it wasn't asked for or capture.py can't tell
+	Liveness *int
+	// the dpi capture.py says it scanned at, 0 when it didn't say
+	Resolution int
+	// everything capture.py logged
+	Stderr string
+}
+
+// Capturer takes fingerprints. The handlers only go through one, so they
+// can run against something that isn't a sensor
+type Capturer interface {
+	Capture(ctx context.Context, opts CaptureOptions) ([]byte, Metadata, error)
+}
+
+// the Capturer the handlers use, apply swaps in mockCapturer for -mock
+var capturer Capturer = CaptureService{}
+
+// CaptureService captures from the sensor, a backend or the pool and checks
+// it got the image that was asked for
+type CaptureService struct{}
+
+func (CaptureService) Capture(ctx context.Context, opts CaptureOptions) ([]byte, Metadata, error) {
+	at := time.Now()
+	var res *captureResult
+	var err error
+	if b, ok := backends[opts.Backend]; ok {
+		res, err = b.capture(ctx, opts.timeout(), opts.args())
+	} else {
+		res, err = runCapture(ctx, opts.timeout(), opts.args()...)
+	}
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return checkCapture(ctx, res, opts, at)
+}
+
+// checkCapture makes sure res is an image of the format opts asked for and
+// collects its metadata
+func checkCapture(ctx context.Context, res *captureResult, opts CaptureOptions, at time.Time) ([]byte, Metadata, error) {
+	format := opts.format()
+	contentType := formats[format]
+	if got := sniffContentType(res.Image); got != contentType {
+		logFor(ctx).Error("capture script wrote something else than the requested image", "event", "capture_bad_image", "want", contentType, "got", got)
+		return nil, Metadata{}, fmt.Errorf("%w, want %s, got %s", errBadImage, contentType, got)
+	}
+	if err := checkBlank(ctx, res.Image); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	meta := Metadata{Format: format, ContentType: contentType, CapturedAt: at, Duration: time.Since(at), QueueWait: res.Wait, Stderr: res.Stderr}
+	if q, ok := res.Quality(); ok {
+		meta.Quality = &q
+	}
+	if dpi, ok := res.Resolution(); ok {
+		meta.Resolution = dpi
+	}
+	if opts.liveness() {
+		if l, ok := res.Liveness(); ok {
+			meta.Liveness = &l
+		}
+		if err := checkLiveness(ctx, meta.Liveness); err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+	return res.Image, meta, nil
+}
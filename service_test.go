@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// failingCapturer fails every capture with err
+type failingCapturer struct {
+	err error
+}
+
+func (f failingCapturer) Capture(ctx context.Context, opts CaptureOptions) ([]byte, Metadata, error) {
+	return nil, Metadata{}, f.err
+}
+
+// useCapturer has the handlers capture with c until the test is done
+func useCapturer(t *testing.T, c Capturer) {
+	t.Helper()
+	old := capturer
+	capturer = c
+	t.Cleanup(func() { capturer = old })
+}
+
+func TestHandleCaptureMock(t *testing.T) {
+	useCapturer(t, mockCapturer{})
+
+	rec := httptest.NewRecorder()
+	HandleCapture(rec, httptest.NewRequest(http.MethodGet, "/capture", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type %q, want image/png", ct)
+	}
+	if !bytes.HasPrefix(rec.Body.Bytes(), pngSignature) {
+		t.Error("body isn't a png")
+	}
+	if q := rec.Header().Get("X-Fingerprint-Quality"); q != "80" {
+		t.Errorf("X-Fingerprint-Quality %q, want 80", q)
+	}
+}
+
+func TestHandleCaptureErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		c      Capturer
+		query  string
+		status int
+		code   string
+	}{
+		{"mock can't make wsq", mockCapturer{}, "?format=wsq", http.StatusBadGateway, codeBadImage},
+		{"busy", failingCapturer{errSensorBusy}, "", http.StatusServiceUnavailable, codeSensorBusy},
+		{"queue full", failingCapturer{&queueFullError{length: 3}}, "", http.StatusServiceUnavailable, codeQueueFull},
+		{"no finger", failingCapturer{fmt.Errorf("%w, after 30s", errNoFinger)}, "", http.StatusRequestTimeout, codeNoFinger},
+		{"blank", failingCapturer{errBlankCapture}, "", http.StatusUnprocessableEntity, codeNoFinger},
+		{"timeout", failingCapturer{fmt.Errorf("%w after 1s", errCaptureTimeout)}, "", http.StatusGatewayTimeout, codeCaptureTimeout},
+		{"python missing", failingCapturer{errPythonMissing}, "", http.StatusServiceUnavailable, codePythonMissing},
+		{"script failed", failingCapturer{&scriptError{Err: errors.New("exit status 1"), Stderr: "boom"}}, "", http.StatusInternalServerError, codeCaptureFailed},
+		{"empty", failingCapturer{errEmptyCapture}, "", http.StatusInternalServerError, codeEmptyCapture},
+		{"anything else", failingCapturer{errors.New("disk on fire")}, "", http.StatusInternalServerError, codeCaptureFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCapturer(t, tt.c)
+
+			rec := httptest.NewRecorder()
+			HandleCapture(rec, httptest.NewRequest(http.MethodGet, "/capture"+tt.query, nil))
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type %q, want application/json", ct)
+			}
+			var body apiErrorBody
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body isn't the error envelope: %v: %s", err, rec.Body)
+			}
+			if body.Error.Code != tt.code {
+				t.Errorf("code %q, want %q", body.Error.Code, tt.code)
+			}
+		})
+	}
+}
+
+// lowThenFailingCapturer answers the mock image with quality 40 the first
+// time and fails every capture after that
+type lowThenFailingCapturer struct {
+	calls int
+}
+
+func (c *lowThenFailingCapturer) Capture(ctx context.Context, opts CaptureOptions) ([]byte, Metadata, error) {
+	if c.calls++; c.calls > 1 {
+		return nil, Metadata{}, errors.New("sensor fell off")
+	}
+	img, meta, err := mockCapturer{}.Capture(ctx, opts)
+	q := 40
+	meta.Quality = &q
+	return img, meta, err
+}
+
+func TestHandleCaptureQualityRetryFails(t *testing.T) {
+	c := &lowThenFailingCapturer{}
+	useCapturer(t, c)
+	oldMin, oldRetries := minQuality, qualityRetries
+	minQuality, qualityRetries = 60, 2
+	t.Cleanup(func() { minQuality, qualityRetries = oldMin, oldRetries })
+
+	rec := httptest.NewRecorder()
+	HandleCapture(rec, httptest.NewRequest(http.MethodGet, "/capture", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200 with the low quality capture: %s", rec.Code, rec.Body)
+	}
+	if c.calls != 2 {
+		t.Errorf("%d captures, want 2, a failing retry ends it", c.calls)
+	}
+	if got := rec.Header().Get("X-Capture-Attempts"); got != "2" {
+		t.Errorf("X-Capture-Attempts %q, want 2", got)
+	}
+	if got, want := rec.Header().Get("X-Quality-Warning"), "422 LOW_QUALITY quality 40 is below 60 after 2 captures"; got != want {
+		t.Errorf("X-Quality-Warning %q, want %q", got, want)
+	}
+}
+
+func TestHandleCaptureQueueLength(t *testing.T) {
+	useCapturer(t, failingCapturer{&queueFullError{length: 3}})
+
+	rec := httptest.NewRecorder()
+	HandleCapture(rec, httptest.NewRequest(http.MethodGet, "/capture", nil))
+	if got := rec.Header().Get("X-Queue-Length"); got != "3" {
+		t.Errorf("X-Queue-Length %q, want 3", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -url-secret, the key capture urls are signed with, empty turns signed
+// urls off
+var urlSecret []byte
+
+const (
+	defaultSignedURLTTL = time.Minute
+	maxSignedURLTTL     = time.Hour
+)
+
+var (
+	errURLExpired    = errors.New("signed url has expired")
+	errURLSigBad     = errors.New("signed url doesn't check out")
+	errURLSigUsed    = errors.New("signed url was already used")
+	errSignedURLsOff = errors.New("signed urls are off, set -url-secret")
+	usedSignedURLs   = struct {
+		sync.Mutex
+		// sig -> when it expires, after that it's rejected for being old
+		m map[string]time.Time
+	}{m: map[string]time.Time{}}
+)
+
+// urlSignature is the HMAC of path and every query parameter but sig
+func urlSignature(path string, q url.Values) string {
+	q = maps.Clone(q)
+	q.Del("sig")
+	mac := hmac.New(sha256.New, urlSecret)
+	mac.Write([]byte(path + "?" + q.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL is path with q, valid until exp
+func signedURL(path string, q url.Values, exp time.Time) string {
+	q = maps.Clone(q)
+	q.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	q.Set("sig", urlSignature(path, q))
+	return path + "?" + q.Encode()
+}
+
+// checkSignedURL makes sure r's sig is ours, hasn't expired and wasn't
+// used before. A good one is used up
+func checkSignedURL(r *http.Request) error {
+	if urlSecret == nil {
+		return errSignedURLsOff
+	}
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil {
+		return errURLSigBad
+	}
+	sig := q.Get("sig")
+	if !hmac.Equal([]byte(sig), []byte(urlSignature(r.URL.Path, q))) {
+		return errURLSigBad
+	}
+	expires := time.Unix(exp, 0)
+	if time.Now().After(expires) {
+		return errURLExpired
+	}
+
+	usedSignedURLs.Lock()
+	defer usedSignedURLs.Unlock()
+	for s, e := range usedSignedURLs.m {
+		if time.Now().After(e) {
+			delete(usedSignedURLs.m, s)
+		}
+	}
+	if _, used := usedSignedURLs.m[sig]; used {
+		return errURLSigUsed
+	}
+	usedSignedURLs.m[sig] = expires
+	return nil
+}
+
+// HandleSignURL mints a one time /capture url for handing to a browser
+// that doesn't get the api key. ?ttl= is how long it's good for, every other
+// parameter ends up in the url and can't be changed without breaking it
+func HandleSignURL(w http.ResponseWriter, r *http.Request) {
+	if urlSecret == nil {
+		writeJSONError(w, http.StatusNotFound, errSignedURLsOff.Error())
+		return
+	}
+	q := r.URL.Query()
+	ttl := defaultSignedURLTTL
+	if v := q.Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", v))
+			return
+		}
+		ttl = min(d, maxSignedURLTTL)
+	}
+	q.Del("ttl")
+	q.Del("exp")
+	q.Del("sig")
+	exp := time.Now().Add(ttl)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"url":       signedURL("/capture", q, exp),
+		"expiresAt": time.Unix(exp.Unix(), 0).UTC(),
+	})
+}
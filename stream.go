@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how much of the image is held back before the answer starts, enough to
+// check it's what was asked for and read its size
+const streamProbe = 4096
+
+// canStream says whether /capture can send the image as capture.py writes
+// it. Whatever has to see the whole image before the headers go out needs
+// it held: a check that can still fail the capture (-reject-quality-below,
+// -min-quality, liveness, the blank check), a header worked out from it
+// (-cache-ttl, -hash, If-None-Match, -debug) or changing it (the transforms,
+// raw, nist, datauri, dest=file, metadata=embedded). Only the -script
+// capture streams, -worker, a backend and -mock don't
+func canStream(r *http.Request, opts CaptureOptions, t transform, format, dest string, embed bool) bool {
+	switch format {
+	case "png", "jpeg", "bmp", "wsq":
+	default:
+		return false
+	}
+	if _, ok := capturer.(CaptureService); !ok || pool != nil || opts.Backend != "" {
+		return false
+	}
+	// the blank check can't read wsq
+	blank := blankThreshold > 0 && format != "wsq"
+	return dest == "" && t.none() && !embed && !opts.liveness() && !blank &&
+		rejectQualityBelow == 0 && minQuality == 0 && captureCacheTTL == 0 &&
+		!hashCaptures && !debugMode && r.Header.Get("If-None-Match") == ""
+}
+
+// HandleCaptureStream is HandleCapture sending the image while capture.py
+// writes it, for when canStream. What's only known once the script is done,
+// the quality and the duration, comes as trailers. A script failing before
+// its first bytes gets the usual error, one failing after that cuts the
+// response off
+func HandleCaptureStream(w http.ResponseWriter, r *http.Request, opts CaptureOptions, dpi int) {
+	sw := &streamWriter{w: w, opts: opts, dpi: dpi, at: time.Now()}
+	if saveDir != "" || webhookURL != "" {
+		sw.keep = &bytes.Buffer{}
+	}
+	done := trackCapture()
+	res, err := streamCapture(r.Context(), opts.timeout(), sw, opts.args())
+	done(err)
+	if err != nil {
+		logError(r, err)
+		if !sw.started {
+			writeCaptureError(w, r, err)
+			return
+		}
+		logFor(r.Context()).Error("capture failed after the image started going out, cutting it off", "event", "capture_stream_failed", "error", err.Error())
+		// the 200 is out, a client must not take half an image for all of it
+		panic(http.ErrAbortHandler)
+	}
+
+	meta := Metadata{Format: opts.format(), ContentType: formats[opts.format()], CapturedAt: sw.at, Duration: time.Since(sw.at), QueueWait: res.Wait, Stderr: res.Stderr}
+	w.Header().Set("X-Capture-Duration-Ms", strconv.FormatInt(meta.Duration.Milliseconds(), 10))
+	if q, ok := res.Quality(); ok {
+		meta.Quality = &q
+		w.Header().Set("X-Fingerprint-Quality", strconv.Itoa(q))
+	}
+	if sw.keep != nil {
+		saveCapture(r.Context(), sw.keep.Bytes(), meta.CapturedAt, meta.Format)
+		sendWebhook(r.Context(), sw.keep.Bytes(), meta)
+	}
+}
+
+// streamCapture is runLocked for the -script capture with stdout going to
+// sw. A failed run is only tried again while nothing was sent
+func streamCapture(ctx context.Context, timeout time.Duration, sw *streamWriter, args []string) (*captureResult, error) {
+	defer useSensor(ctx)()
+	args = withScriptArgs(args)
+	wait, err := acquireLock(ctx, sensorLock)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, abortedError(ctx)
+		}
+		logFor(ctx).Warn("sensor is busy, rejecting capture", "error", err.Error())
+		return nil, err
+	}
+	defer sensorLock.release()
+	sw.wait = wait
+
+	runningCaptures.Add(1)
+	defer runningCaptures.Done()
+
+	ctx, cancel := captureContext(ctx, timeout)
+	defer cancel()
+
+	var stderr string
+	err = retryCapture(ctx, func() (bool, error) {
+		sw.reset()
+		cmdCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		sw.cancel = cancel
+		var err error
+		stderr, err = runScriptTo(ctx, cmdCtx, timeout, pythonExecutable(), scriptPath, args, sw)
+		if sw.failed != nil {
+			return false, sw.failed
+		}
+		if err == nil && !sw.started {
+			// all of it fit in the probe
+			err = sw.start()
+		}
+		return !sw.started, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &captureResult{Stderr: stderr, Wait: wait}, nil
+}
+
+// streamWriter is capture.py's stdout for HandleCaptureStream. It holds the
+// first streamProbe bytes back, then writes the headers and passes
+// everything on
+type streamWriter struct {
+	w    http.ResponseWriter
+	opts CaptureOptions
+	dpi  int
+	at   time.Time
+	wait time.Duration
+	// a copy for -save-dir and the webhook, nil without them
+	keep *bytes.Buffer
+
+	cancel  context.CancelFunc
+	head    []byte
+	out     io.Writer
+	n       int
+	started bool
+	// what made it cancel the script, the client going away or a bad image
+	failed   error
+	tooLarge bool
+}
+
+// reset is for a new try, nothing was sent yet
+func (s *streamWriter) reset() {
+	s.head, s.n, s.failed, s.tooLarge = s.head[:0], 0, nil, false
+	if s.keep != nil {
+		s.keep.Reset()
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.n+len(p) > maxImageBytes {
+		s.tooLarge = true
+		s.cancel()
+		return 0, errImageTooLarge
+	}
+	s.n += len(p)
+	if s.keep != nil {
+		s.keep.Write(p)
+	}
+	if !s.started {
+		s.head = append(s.head, p...)
+		if len(s.head) < streamProbe {
+			return len(p), nil
+		}
+		if err := s.start(); err != nil {
+			s.failed = err
+			s.cancel()
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if _, err := s.out.Write(p); err != nil {
+		s.failed = err
+		s.cancel()
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start checks the held back bytes are the image that was asked for and
+// sends the headers and them
+func (s *streamWriter) start() error {
+	format := s.opts.format()
+	contentType := formats[format]
+	if got := sniffContentType(s.head); got != contentType {
+		return fmt.Errorf("%w, want %s, got %s", errBadImage, contentType, got)
+	}
+
+	h := s.w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Capture-Timestamp", s.at.UTC().Format(time.RFC3339Nano))
+	if s.wait > 0 {
+		h.Set("X-Queue-Wait-Ms", strconv.FormatInt(s.wait.Milliseconds(), 10))
+	}
+	if s.opts.Resolution > 0 {
+		h.Set("X-Image-Resolution", strconv.Itoa(s.opts.Resolution))
+	}
+	h.Set("X-Image-DPI", strconv.Itoa(s.dpi))
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(s.head)); err == nil {
+		setImageSize(h, cfg.Width, cfg.Height)
+	}
+	h.Set("Trailer", "X-Capture-Duration-Ms, X-Fingerprint-Quality")
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+
+	s.out = s.w
+	if format == "png" {
+		s.out = &pngDPIWriter{w: s.w, dpi: s.dpi}
+	}
+	_, err := s.out.Write(s.head)
+	return err
+}
+
+func (s *streamWriter) Len() int        { return s.n }
+func (s *streamWriter) String() string  { return "" }
+func (s *streamWriter) overLimit() bool { return s.tooLarge }
+
+// pngDPIWriter is setPNGDPI for a png that's still being written, it passes
+// the chunks on to w as they come with a pHYs for dpi right after IHDR,
+// leaving out the one capture.py wrote
+type pngDPIWriter struct {
+	w   io.Writer
+	dpi int
+	// the signature or a chunk's length and type while they aren't all there
+	pending []byte
+	signed  bool
+	// what's left of the current chunk, its data and crc
+	left int
+	skip bool
+	ihdr bool
+}
+
+func (p *pngDPIWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if p.left > 0 {
+			k := min(len(b), p.left)
+			if !p.skip {
+				if _, err := p.w.Write(b[:k]); err != nil {
+					return 0, err
+				}
+			}
+			b, p.left = b[k:], p.left-k
+			if p.left == 0 && p.ihdr {
+				var phys bytes.Buffer
+				writePHYs(&phys, p.dpi)
+				if _, err := p.w.Write(phys.Bytes()); err != nil {
+					return 0, err
+				}
+				p.ihdr = false
+			}
+			continue
+		}
+
+		k := min(len(b), 8-len(p.pending))
+		p.pending = append(p.pending, b[:k]...)
+		b = b[k:]
+		if len(p.pending) < 8 {
+			break
+		}
+		if !p.signed {
+			if !bytes.Equal(p.pending, pngSignature) {
+				return 0, errors.New("not a png")
+			}
+			p.signed = true
+		} else {
+			size := binary.BigEndian.Uint32(p.pending)
+			if size > uint32(maxImageBytes) {
+				return 0, errors.New("png chunk is too large")
+			}
+			typ := string(p.pending[4:8])
+			p.left, p.skip, p.ihdr = int(size)+4, typ == "pHYs", typ == "IHDR"
+		}
+		if !p.skip {
+			if _, err := p.w.Write(p.pending); err != nil {
+				return 0, err
+			}
+		}
+		p.pending = p.pending[:0]
+	}
+	return n, nil
+}
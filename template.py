@@ -0,0 +1,54 @@
+import sys
+import json
+import argparse
+
+from match import CMP_W, CMP_H, DEFAULT_THRESHOLD, best_correlation, load
+
+# first bytes of every template so we don't compare garbage
+MAGIC = b"FPT1"
+
+
+def log(*args):
+    print(*args, file=sys.stderr)
+
+
+def extract(image_path: str) -> bytes:
+    """Template is the downscaled print, mean removed and clamped to a byte per pixel."""
+    px = load(image_path)
+    return MAGIC + bytes(min(max(int(p) + 128, 0), 255) for p in px)
+
+
+def read_template(path: str) -> list[float]:
+    with open(path, "rb") as f:
+        data = f.read()
+    if not data.startswith(MAGIC) or len(data) != len(MAGIC) + CMP_W * CMP_H:
+        raise SystemExit(f"{path} isn't a template")
+    return [b - 128 for b in data[len(MAGIC):]]
+
+
+def compare(a_path: str, b_path: str) -> float:
+    return best_correlation(read_template(a_path), read_template(b_path))
+
+
+def main():
+    p = argparse.ArgumentParser(description="Extract and compare fingerprint templates")
+    sub = p.add_subparsers(dest="cmd", required=True)
+    ex = sub.add_parser("extract", help="write the template of an image to stdout")
+    ex.add_argument("image")
+    cmp = sub.add_parser("compare", help="compare two templates, writes json to stdout")
+    cmp.add_argument("template")
+    cmp.add_argument("candidate")
+    cmp.add_argument("--threshold", type=float, default=DEFAULT_THRESHOLD)
+    args = p.parse_args()
+
+    if args.cmd == "extract":
+        sys.stdout.buffer.write(extract(args.image))
+        return
+
+    s = compare(args.template, args.candidate)
+    log(f"score={s:.3f} threshold={args.threshold}")
+    json.dump({"match": s >= args.threshold, "score": round(s, 3)}, sys.stdout)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var errTemplateNotFound = errors.New("no template enrolled")
+
+// user ids end up as file names, so keep them boring
+var validTemplateID = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+// TemplateStore keeps one enrolled template per user id
+type TemplateStore interface {
+	Put(id string, template []byte) error
+	// Get returns errTemplateNotFound when id was never enrolled
+	Get(id string) ([]byte, error)
+}
+
+// fileTemplateStore keeps every template in <dir>/<id>.tpl
+type fileTemplateStore struct {
+	dir string
+}
+
+func newFileTemplateStore(dir string) (*fileTemplateStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileTemplateStore{dir: dir}, nil
+}
+
+func (s *fileTemplateStore) path(id string) string {
+	return filepath.Join(s.dir, id+".tpl")
+}
+
+func (s *fileTemplateStore) Put(id string, template []byte) error {
+	// write next to it and rename so a crash never leaves half a template
+	tmp, err := os.CreateTemp(s.dir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(template); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(id))
+}
+
+func (s *fileTemplateStore) Get(id string) ([]byte, error) {
+	b, err := os.ReadFile(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errTemplateNotFound
+	}
+	return b, err
+}
+
+var (
+	templates TemplateStore
+	// absolute path of the template script, resolved once in main
+	templateScriptPath string
+)
+
+// HandleEnroll captures a print and stores its template for ?id=
+func HandleEnroll(w http.ResponseWriter, r *http.Request) {
+	id, ok := templateID(w, r)
+	if !ok {
+		return
+	}
+
+	tmpl, ok := captureTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := templates.Put(id, tmpl); err != nil {
+		logError(r, err)
+		writeJSONError(w, http.StatusInternalServerError, "can't store template")
+		return
+	}
+	recentTemplates.add(tmpl)
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "enrolled": true})
+}
+
+// HandleVerify captures a print and compares it with the template enrolled
+// for ?id=
+func HandleVerify(w http.ResponseWriter, r *http.Request) {
+	id, ok := templateID(w, r)
+	if !ok {
+		return
+	}
+
+	enrolled, err := templates.Get(id)
+	if errors.Is(err, errTemplateNotFound) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no template enrolled for %q", id))
+		return
+	}
+	if err != nil {
+		logError(r, err)
+		writeJSONError(w, http.StatusInternalServerError, "can't read template")
+		return
+	}
+
+	tmpl, ok := captureTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := compareTemplates(r.Context(), enrolled, tmpl)
+	if err != nil {
+		logError(r, err)
+		writeScriptError(w, "Template compare", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "match": res.Match, "score": res.Score})
+}
+
+// HandleTemplate captures a print and sends its template without storing
+// anything, for clients that match on their own. ?format=json sends it
+// base64 encoded
+func HandleTemplate(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format %q, want json or none", format))
+		return
+	}
+
+	tmpl, ok := captureTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	if format == "json" {
+		writeJSON(w, http.StatusOK, map[string]any{"template": base64.StdEncoding.EncodeToString(tmpl), "size": len(tmpl)})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(tmpl)
+}
+
+func templateID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.URL.Query().Get("id")
+	if !validTemplateID.MatchString(id) {
+		writeJSONError(w, http.StatusBadRequest, "id must be 1-64 letters, digits, '.', '_' or '-'")
+		return "", false
+	}
+	return id, true
+}
+
+// captureTemplate captures a print and runs template extraction on it, on
+// failure the error response is already written
+func captureTemplate(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	w.Header().Set("X-Capture-Timeout", timeout.String())
+
+	done := trackCapture()
+	img, _, err := capturer.Capture(r.Context(), CaptureOptions{Timeout: timeout})
+	done(err)
+	if err != nil {
+		logError(r, err)
+		status, msg := captureStatus(err)
+		writeJSONError(w, status, msg)
+		return nil, false
+	}
+
+	tmpl, err := extractTemplate(r.Context(), img)
+	if err != nil {
+		logError(r, err)
+		writeScriptError(w, "Template extraction", err)
+		return nil, false
+	}
+	return tmpl, true
+}
+
+// extractTemplate runs the template script on a png
+func extractTemplate(ctx context.Context, img []byte) ([]byte, error) {
+	path, err := writeTemp(bytes.NewReader(img), "capture")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	return runPython(ctx, captureTimeout, templateScriptPath, "extract", path)
+}
+
+func compareTemplates(ctx context.Context, a, b []byte) (matchResult, error) {
+	var res matchResult
+	var paths []string
+	defer func() {
+		for _, p := range paths {
+			os.Remove(p)
+		}
+	}()
+	for _, t := range [][]byte{a, b} {
+		path, err := writeTemp(bytes.NewReader(t), "template")
+		if err != nil {
+			return res, err
+		}
+		paths = append(paths, path)
+	}
+
+	out, err := runPython(ctx, captureTimeout, templateScriptPath, "compare", paths[0], paths[1])
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return res, fmt.Errorf("template script returned invalid json: %w", err)
+	}
+	return res, nil
+}
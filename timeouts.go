@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// how long a client gets to send the request headers, slow loris clients
+// trickle them in
+const readHeaderTimeout = 10 * time.Second
+
+// writeTimeout is -write-timeout, 0 picks one the slowest capture fits in:
+// -max-timeout for every try -attempts and -min-quality may take, plus a
+// minute for waiting on the sensor and sending the image
+func (c *Config) writeTimeout() time.Duration {
+	if c.WriteTimeout > 0 {
+		return c.WriteTimeout
+	}
+	tries := c.Attempts
+	if c.MinQuality > 0 {
+		tries *= 1 + c.QualityRetries
+	}
+	return c.MaxTimeout*time.Duration(tries) + time.Minute
+}
+
+// noTimeoutMiddleWare lifts -read-timeout and -write-timeout for next, for
+// the streams and batches that run as long as the client keeps them open.
+// The read one for the preview websocket, the hijacked connection keeps the
+// deadline and its reads would fail after -read-timeout
+func noTimeoutMiddleWare(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		err := rc.SetReadDeadline(time.Time{})
+		if err == nil {
+			err = rc.SetWriteDeadline(time.Time{})
+		}
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			logFor(r.Context()).Warn("can't lift the server timeouts", "error", err.Error())
+		}
+		next(w, r)
+	}
+}
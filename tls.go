@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type tlsOptions struct {
+	certFile, keyFile string
+	// get a certificate from let's encrypt instead of using the files
+	autocertDomain string
+	autocertCache  string
+}
+
+func (o tlsOptions) validate() error {
+	if (o.certFile == "") != (o.keyFile == "") {
+		return errors.New("-tls-cert and -tls-key have to be set together")
+	}
+	if o.autocertDomain != "" && o.certFile != "" {
+		return errors.New("-autocert-domain can't be combined with -tls-cert and -tls-key")
+	}
+	return nil
+}
+
+// serve runs srv on ln, over TLS when it's configured
+func serve(srv *http.Server, ln net.Listener, o tlsOptions) error {
+	addr := ln.Addr().String()
+	switch {
+	case o.autocertDomain != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(o.autocertDomain),
+			Cache:      autocert.DirCache(o.autocertCache),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		slog.Info("starting server", "addr", addr, "tls", true, "autocert_domain", o.autocertDomain)
+		return srv.ServeTLS(ln, "", "")
+	case o.certFile != "":
+		slog.Info("starting server", "addr", addr, "tls", true, "cert", o.certFile)
+		return srv.ServeTLS(ln, o.certFile, o.keyFile)
+	}
+	slog.Info("starting server", "addr", addr, "tls", false)
+	return srv.Serve(ln)
+}
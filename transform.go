@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+)
+
+var errCropOutside = errors.New("crop is outside the image")
+
+// the biggest ?width= and ?height=, a few times the sensor's own size
+const maxResizeDimension = 4096
+
+// transform is the ?rotate= and ?crop= post processing of a capture, for
+// sensors that are mounted sideways or upside down, plus ?autocrop=,
+// ?width=, ?height=, -normalize and -gamma
+type transform struct {
+	// clockwise, 0, 90, 180 or 270
+	rotate int
+	// in the rotated image, empty keeps all of it
+	crop image.Rectangle
+	// crop to the finger, after rotate and crop
+	autocrop bool
+	// scale to this size last, 0 for one of them keeps the aspect ratio
+	width, height int
+
+	normalize bool
+	// 0 and 1 leave the image as is
+	gamma float64
+}
+
+func (t transform) none() bool {
+	return t.rotate == 0 && t.crop.Empty() && !t.autocrop && !t.resizes() && !t.adjustsLevels()
+}
+
+func (t transform) resizes() bool {
+	return t.width > 0 || t.height > 0
+}
+
+func (t transform) adjustsLevels() bool {
+	return t.normalize || (t.gamma > 0 && t.gamma != 1)
+}
+
+// parseTransform reads ?rotate=90|180|270, ?crop=x,y,w,h, ?autocrop=1,
+// ?width= and ?height= from r
+func parseTransform(r *http.Request) (transform, error) {
+	t := transform{normalize: normalizeImages, gamma: imageGamma}
+	switch v := r.URL.Query().Get("autocrop"); v {
+	case "", "0":
+	case "1":
+		t.autocrop = true
+	default:
+		return t, fmt.Errorf("invalid autocrop %q, want 1", v)
+	}
+	if v := r.URL.Query().Get("rotate"); v != "" {
+		switch v {
+		case "0", "90", "180", "270":
+			t.rotate, _ = strconv.Atoi(v)
+		default:
+			return t, fmt.Errorf("invalid rotate %q, want 90, 180 or 270", v)
+		}
+	}
+	if v := r.URL.Query().Get("crop"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return t, fmt.Errorf("invalid crop %q, want x,y,w,h", v)
+		}
+		var n [4]int
+		for i, p := range parts {
+			var err error
+			if n[i], err = strconv.Atoi(strings.TrimSpace(p)); err != nil || n[i] < 0 {
+				return t, fmt.Errorf("invalid crop %q, want x,y,w,h", v)
+			}
+		}
+		if n[2] == 0 || n[3] == 0 {
+			return t, fmt.Errorf("invalid crop %q, width and height can't be 0", v)
+		}
+		t.crop = image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3])
+	}
+	for _, p := range []struct {
+		name string
+		n    *int
+	}{{"width", &t.width}, {"height", &t.height}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxResizeDimension {
+			return t, fmt.Errorf("invalid %s %q, want 1 to %d", p.name, v, maxResizeDimension)
+		}
+		*p.n = n
+	}
+	return t, nil
+}
+
+// apply decodes img, rotates and crops it and encodes it again in format.
+// A crop that doesn't fit the image is an error. box is what autocrop kept,
+// empty when it found no finger or wasn't asked for
+func (t transform) apply(img []byte, format string) (_ []byte, box image.Rectangle, err error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, box, fmt.Errorf("can't decode capture: %w", err)
+	}
+
+	out := rotate(src, t.rotate)
+	if !t.crop.Empty() {
+		crop := t.crop.Add(out.Bounds().Min)
+		if !crop.In(out.Bounds()) {
+			size := out.Bounds().Size()
+			return nil, box, fmt.Errorf("%w, it's %dx%d", errCropOutside, size.X, size.Y)
+		}
+		out = cropTo(out, crop)
+	}
+	if t.autocrop {
+		if found, ok := foregroundBox(out); ok {
+			box = found.Sub(out.Bounds().Min)
+			out = cropTo(out, found)
+		}
+	}
+	if t.adjustsLevels() {
+		out = levels(out, t.normalize, t.gamma)
+	}
+	if t.resizes() {
+		out = resize(out, t.width, t.height)
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: 95})
+	case "bmp":
+		err = bmp.Encode(&buf, out)
+	default:
+		err = png.Encode(&buf, out)
+	}
+	if err != nil {
+		return nil, box, err
+	}
+	return buf.Bytes(), box, nil
+}
+
+// cropTo copies r out of src, r is in src's coordinates
+func cropTo(src image.Image, r image.Rectangle) image.Image {
+	dst := newLike(src, image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, r.Min, draw.Src)
+	return dst
+}
+
+// resize scales src to width x height with Catmull-Rom, which keeps ridges
+// sharper than bilinear. A 0 is worked out from the other to keep the
+// aspect ratio, capped at maxResizeDimension like the one asked for, an
+// upload 4096x1 scaled to ?height=4096 would be 16 million pixels wide
+func resize(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	switch {
+	case width == 0:
+		width = min(maxResizeDimension, max(1, (b.Dx()*height+b.Dy()/2)/b.Dy()))
+	case height == 0:
+		height = min(maxResizeDimension, max(1, (b.Dy()*width+b.Dx()/2)/b.Dx()))
+	}
+	dst := newLike(src, image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// rotate turns src clockwise by deg
+func rotate(src image.Image, deg int) image.Image {
+	if deg == 0 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	size := image.Rect(0, 0, h, w)
+	if deg == 180 {
+		size = image.Rect(0, 0, w, h)
+	}
+	dst := newLike(src, size)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := src.At(b.Min.X+x, b.Min.Y+y)
+			switch deg {
+			case 90:
+				dst.Set(h-1-y, x, c)
+			case 180:
+				dst.Set(w-1-x, h-1-y, c)
+			case 270:
+				dst.Set(y, w-1-x, c)
+			}
+		}
+	}
+	return dst
+}
+
+// newLike makes an image of r that keeps src grayscale if it was, the
+// sensor only ever gives us gray
+func newLike(src image.Image, r image.Rectangle) draw.Image {
+	if src.ColorModel() == color.GrayModel {
+		return image.NewGray(r)
+	}
+	return image.NewNRGBA(r)
+}
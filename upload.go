@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// -max-upload-bytes, the most a /match, /process or /verify request body can
+// be. Two images of -max-image-bytes fit in the default
+var maxUploadBytes = 10 << 20
+
+// uploadLimitMiddleWare caps the request body at maxUploadBytes. A
+// Content-Length over it is turned away right here, reading past it fails
+// with a *http.MaxBytesError that the handler turns into a 413
+func uploadLimitMiddleWare(callback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := int64(maxUploadBytes)
+		if r.ContentLength > limit {
+			http.Error(w, uploadTooLarge(limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		callback(w, r)
+	}
+}
+
+// uploadTooLarge is the message of a 413 for going over limit
+func uploadTooLarge(limit int64) string {
+	return fmt.Sprintf("request body is over %d bytes", limit)
+}
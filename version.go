@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// set at build time, see build.sh
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=abc123 -X main.buildDate=2025-01-01T00:00:00Z"
+var version, commit, buildDate string
+
+type versionJSON struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	Script    string `json:"script"`
+	Python    string `json:"python"`
+	// -script-args, what every capture.py run gets on top of its own flags
+	ScriptArgs []string `json:"scriptArgs"`
+}
+
+func versionString() string {
+	return fmt.Sprintf("fingerprint-server %s (commit %s, built %s)", buildVersion(), orUnknown(commit), orUnknown(buildDate))
+}
+
+// buildVersion is version, or dev for a plain go build
+func buildVersion() string {
+	if version == "" {
+		return "dev"
+	}
+	return version
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// HandleVersion tells which build is running and which python and capture
+// script it ended up with
+func HandleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionJSON{
+		Version:    buildVersion(),
+		Commit:     orUnknown(commit),
+		BuildDate:  orUnknown(buildDate),
+		Script:     scriptPath,
+		Python:     pythonExecutable(),
+		ScriptArgs: extraScriptArgs,
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// set while -wait-for-sensor polls for the sensor at startup
+var waitingForSensor atomic.Bool
+
+const waitingForSensorMessage = "Waiting for the sensor to show up, try again shortly"
+
+// how long -wait-for-sensor sleeps between polls
+const sensorPollInterval = 2 * time.Second
+
+// waitForSensor asks capture.py for the sensor until it's connected, timeout
+// has gone by or ctx is done. A usb sensor may take a while to enumerate
+// after boot. Every poll is logged
+func waitForSensor(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		st, err := checkSensor(ctx)
+		if err == nil {
+			slog.Info("sensor is connected, taking captures", "event", "sensor_wait_ok", "attempt", attempt, "mode", st.Mode, "model", st.Model, "waited", time.Since(start).String())
+			return
+		}
+		slog.Info("no sensor yet", "event", "sensor_wait", "attempt", attempt, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			slog.Warn("gave up waiting for the sensor, taking captures anyway", "event", "sensor_wait_timeout", "attempts", attempt, "waited", time.Since(start).String())
+			return
+		case <-time.After(sensorPollInterval):
+		}
+	}
+}
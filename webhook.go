@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// every successful /capture is posted here, empty turns it off
+	webhookURL     string
+	webhookTimeout = 10 * time.Second
+	// tries per capture, including the first one
+	webhookAttempts = 3
+)
+
+// webhooks still being delivered, shutdown waits for them
+var pendingWebhooks sync.WaitGroup
+
+type webhookPayload struct {
+	RequestID   string    `json:"requestId"`
+	CapturedAt  time.Time `json:"capturedAt"`
+	Format      string    `json:"format"`
+	Quality     *int      `json:"quality,omitempty"`
+	ImageBase64 string    `json:"imageBase64"`
+}
+
+// sendWebhook posts the capture to webhookURL in the background. The client
+// already has its answer, so a failed delivery is only logged
+func sendWebhook(ctx context.Context, img []byte, meta Metadata) {
+	if webhookURL == "" {
+		return
+	}
+	payload := webhookPayload{
+		RequestID:   requestID(ctx),
+		CapturedAt:  meta.CapturedAt.UTC(),
+		Format:      meta.Format,
+		Quality:     meta.Quality,
+		ImageBase64: base64.StdEncoding.EncodeToString(img),
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logFor(ctx).Error("can't encode webhook payload", "event", "webhook_failed", "error", err.Error())
+		return
+	}
+
+	// the request is over by the time this runs, only its logger is kept
+	ctx = context.WithoutCancel(ctx)
+	pendingWebhooks.Add(1)
+	go func() {
+		defer pendingWebhooks.Done()
+		for n := 1; ; n++ {
+			err := postWebhook(ctx, body)
+			if err == nil {
+				logFor(ctx).Info("delivered webhook", "event", "webhook_sent", "attempt", n)
+				return
+			}
+			if n >= webhookAttempts {
+				logFor(ctx).Error("webhook failed, giving up", "event", "webhook_failed", "attempt", n, "error", err.Error())
+				return
+			}
+			logFor(ctx).Warn("webhook failed, retrying", "event", "webhook_retry", "attempt", n, "error", err.Error())
+			time.Sleep(time.Duration(n) * time.Second)
+		}
+	}()
+}
+
+func postWebhook(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// what -service install registers the server as
+const serviceName = "fingerprint-sensor-server"
+
+// serviceArgs is args without -service, plus -service run, what the
+// installed service is started with
+func serviceArgs(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != "service" {
+			out = append(out, args[i])
+			continue
+		}
+		if !hasValue {
+			i++
+		}
+	}
+	return append(out, "-service", "run")
+}
+
+// chdirToExecutable makes the directory of the running exe the working
+// directory
+func chdirToExecutable() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return os.Chdir(filepath.Dir(exe))
+}
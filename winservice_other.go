@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNoService = errors.New("-service is only for windows, use systemd or launchd here")
+
+func inService() bool {
+	return false
+}
+
+func installService([]string) error {
+	return errNoService
+}
+
+func uninstallService() error {
+	return errNoService
+}
+
+func runService(func(ctx context.Context)) error {
+	return errNoService
+}
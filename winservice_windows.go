@@ -0,0 +1,114 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// inService is whether windows started us as a service
+func inService() bool {
+	ok, _ := svc.IsWindowsService()
+	return ok
+}
+
+// installService registers the exe as serviceName started with args, it
+// starts with windows and is restarted when it dies
+func installService(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("%s is already installed, uninstall it first", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Fingerprint sensor server",
+		Description: "Serves the fingerprint sensor over http",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+	}, 24*60*60)
+}
+
+// uninstallService removes serviceName, a running one is stopped by windows
+// once nothing has it open anymore
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("%s isn't installed", serviceName)
+	}
+	defer s.Close()
+	s.Control(svc.Stop)
+	return s.Delete()
+}
+
+// runService runs serve as serviceName, the context it gets is done when
+// windows asks the service to stop
+func runService(serve func(ctx context.Context)) error {
+	if !inService() {
+		return errors.New("-service run is for windows to start the installed service, use -service install")
+	}
+	return svc.Run(serviceName, serviceHandler{serve: serve})
+}
+
+type serviceHandler struct {
+	serve func(ctx context.Context)
+}
+
+func (h serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.serve(ctx)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case c := <-requests:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// the drain of run still happens, windows waits for it
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
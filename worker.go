@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captureWorker is one long running `capture.py --worker`. Captures are sent
+// to it on stdin instead of starting python, importing everything and loading
+// the DLL for every single one
+type captureWorker struct {
+	// the sensor this worker always captures from, "" takes whatever the
+	// capture asks for
+	device string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	// its stderr, relays the EVENT: lines to the capture in flight
+	events *eventWriter
+	// crashes in a row, a capture that works resets it
+	crashes int
+	// set by Stop, a revive that's still pending doesn't start it again
+	stopped bool
+
+	// set while a crashed worker waits out its backoff, captures fail right
+	// away instead of waiting for it
+	down      atomic.Bool
+	revivesAt atomic.Int64
+}
+
+// -worker-backoff and -worker-backoff-max, how long a crashed worker waits
+// before it's started again. It doubles with every crash in a row
+var (
+	workerBackoff    = time.Second
+	workerBackoffMax = 30 * time.Second
+)
+
+var errWorkerDown = errors.New("capture worker is down")
+
+// workerDownError is errWorkerDown with when it's back, the client gets it
+// as Retry-After
+type workerDownError struct {
+	retryIn time.Duration
+}
+
+func (e *workerDownError) Error() string {
+	return fmt.Sprintf("%s, restarting it in %s", errWorkerDown, e.retryIn.Round(time.Second))
+}
+
+func (e *workerDownError) Is(target error) bool {
+	return target == errWorkerDown
+}
+
+type workerRequest struct {
+	Args []string `json:"args"`
+}
+
+type workerResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	// capture.py's exitNoFinger
+	NoFinger bool `json:"noFinger"`
+	// what the script logged for this capture, including the QUALITY= line
+	Stderr string `json:"stderr"`
+}
+
+func (w *captureWorker) start() error {
+	cmd := exec.CommandContext(capturesCtx, pythonExecutable(), scriptPath, "--worker")
+	cmd.Dir = scriptWorkDir(scriptPath)
+	cmd.Env = scriptEnv()
+	// its own logging comes back with every answer, so this is the EVENT:
+	// lines of the capture in flight, tracebacks and other surprises
+	w.events = &eventWriter{next: &logWriter{msg: "capture worker output", event: "worker_stderr", level: slog.LevelWarn}}
+	cmd.Stderr = w.events
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	w.cmd, w.stdin, w.stdout = cmd, stdin, bufio.NewReader(stdout)
+	slog.Info("started capture worker", "event", "worker_started", "device", w.device, "pid", cmd.Process.Pid)
+	return nil
+}
+
+// Start starts the worker at boot so the first capture doesn't pay for it,
+// one that doesn't start is tried again after the backoff
+func (w *captureWorker) Start() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.start(); err != nil {
+		w.crashed(context.Background(), err.Error())
+		return err
+	}
+	return nil
+}
+
+// stop kills the worker and waits for it to be gone
+func (w *captureWorker) stop() {
+	if w.cmd == nil {
+		return
+	}
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	w.cmd.Wait()
+	w.cmd = nil
+}
+
+// Idle stops the worker until its next capture
+func (w *captureWorker) Idle() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stop()
+}
+
+// Stop is for shutdown, closing stdin is enough for a healthy worker to exit
+func (w *captureWorker) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.cmd == nil {
+		return
+	}
+	w.stdin.Close()
+	done := make(chan struct{})
+	go func() {
+		w.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		w.cmd.Process.Kill()
+		<-done
+	}
+	w.cmd = nil
+}
+
+// restart replaces a worker that died or got stuck, stop is a no-op when
+// it's already gone
+func (w *captureWorker) restart(ctx context.Context, reason string) {
+	w.stop()
+	if capturesCtx.Err() != nil {
+		return
+	}
+	logFor(ctx).Warn("restarting capture worker", "event", "worker_restart", "device", w.device, "reason", reason)
+	workerRestarts.Inc()
+	if err := w.start(); err != nil {
+		logFor(ctx).Error("can't restart capture worker", "event", "worker_restart_failed", "error", err.Error())
+		w.crashed(ctx, err.Error())
+	}
+}
+
+// crashed takes a worker that died out of service and starts it again after
+// workerBackoff, doubled for every crash in a row up to workerBackoffMax.
+// w.mu is held
+func (w *captureWorker) crashed(ctx context.Context, reason string) {
+	w.stop()
+	if capturesCtx.Err() != nil || w.stopped {
+		return
+	}
+	w.crashes++
+	backoff := workerBackoffMax
+	if w.crashes < 32 {
+		backoff = min(workerBackoff<<(w.crashes-1), workerBackoffMax)
+	}
+	w.revivesAt.Store(time.Now().Add(backoff).UnixNano())
+	w.down.Store(true)
+	logFor(ctx).Error("capture worker crashed, starting it again after a backoff", "event", "worker_crashed", "device", w.device, "reason", reason, "crashes", w.crashes, "backoff", backoff.String())
+	time.AfterFunc(backoff, w.revive)
+}
+
+// revive starts a crashed worker once its backoff is over
+func (w *captureWorker) revive() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if capturesCtx.Err() != nil || w.stopped {
+		return
+	}
+	slog.Warn("restarting capture worker", "event", "worker_restart", "device", w.device, "crashes", w.crashes)
+	workerRestarts.Inc()
+	if err := w.start(); err != nil {
+		w.crashed(context.Background(), err.Error())
+		return
+	}
+	w.down.Store(false)
+}
+
+// downError is the workerDownError for a capture that got w while it's down
+func (w *captureWorker) downError() error {
+	return &workerDownError{retryIn: max(time.Until(time.Unix(0, w.revivesAt.Load())), 0)}
+}
+
+// capture runs one capture with args on the worker. A timeout fails only the
+// capture in flight and the worker is restarted right away, a crash takes it
+// down for its backoff and captures fail fast with a workerDownError meanwhile
+func (w *captureWorker) capture(ctx context.Context, timeout time.Duration, args []string) (*captureResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.down.Load() {
+		err := w.downError()
+		logFor(ctx).Warn("capture worker is down, rejecting capture", "device", w.device, "error", err.Error())
+		return nil, err
+	}
+	if w.cmd == nil {
+		if err := w.start(); err != nil {
+			w.crashed(ctx, err.Error())
+			if missing := pythonMissing(ctx, pythonExecutable(), scriptPath, err); missing != nil {
+				return nil, missing
+			}
+			return nil, commandError(ctx, timeout, err, "", "")
+		}
+	}
+
+	type answer struct {
+		resp  workerResponse
+		image []byte
+		err   error
+	}
+	answered := make(chan answer, 1)
+	stdin, stdout := w.stdin, w.stdout
+	w.events.listen(ctx)
+	defer w.events.listen(nil)
+	go func() {
+		var a answer
+		a.resp, a.image, a.err = roundTrip(stdin, stdout, args)
+		answered <- a
+	}()
+
+	var a answer
+	select {
+	case a = <-answered:
+	case <-ctx.Done():
+		// the worker is stuck in the capture, the only way out is killing it
+		w.stop()
+		<-answered
+		w.restart(ctx, ctx.Err().Error())
+		return nil, commandError(ctx, timeout, ctx.Err(), "", "")
+	}
+
+	if errors.Is(a.err, errImageTooLarge) {
+		// the rest of the frame is still in the pipe, the worker has to go
+		w.restart(ctx, a.err.Error())
+		return nil, imageTooLarge(ctx, scriptPath)
+	}
+	if a.err != nil {
+		w.crashed(ctx, a.err.Error())
+		if missing := pythonMissing(ctx, pythonExecutable(), scriptPath, a.err); missing != nil {
+			return nil, missing
+		}
+		return nil, commandError(ctx, timeout, fmt.Errorf("capture worker died: %w", a.err), "", "")
+	}
+	// it answered, whatever it said it's alive
+	w.crashes = 0
+	if a.resp.NoFinger {
+		return nil, noFingerError(ctx, a.resp.Stderr)
+	}
+	if !a.resp.OK {
+		return nil, commandError(ctx, timeout, errors.New(a.resp.Error), "", a.resp.Stderr)
+	}
+	return &captureResult{Image: a.image, Stderr: a.resp.Stderr}, nil
+}
+
+// roundTrip sends one command to a worker and reads its answer, an error
+// means the worker can't be talked to anymore
+func roundTrip(stdin io.Writer, stdout io.Reader, args []string) (workerResponse, []byte, error) {
+	var resp workerResponse
+	if err := json.NewEncoder(stdin).Encode(workerRequest{Args: args}); err != nil {
+		return resp, nil, err
+	}
+	header, err := readFrame(stdout)
+	if err != nil {
+		return resp, nil, err
+	}
+	if err := json.Unmarshal(header, &resp); err != nil {
+		return resp, nil, fmt.Errorf("bad answer: %w", err)
+	}
+	if !resp.OK {
+		return resp, nil, nil
+	}
+	image, err := readFrame(stdout)
+	return resp, image, err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// wsq is the FBI's fingerprint compression, it's only defined for 500 dpi
+// scans. capture.py encodes it with the wsq Pillow plugin
+const wsqDPI = 500
+
+// a wsq file starts with the SOI marker
+var wsqSignature = []byte{0xff, 0xa0}
+
+// sniffContentType is http.DetectContentType plus wsq, which it doesn't know
+func sniffContentType(b []byte) string {
+	if bytes.HasPrefix(b, wsqSignature) {
+		return formats["wsq"]
+	}
+	return http.DetectContentType(b)
+}
+
+// formatDPI is the dpi a capture in format gets tagged with
+func formatDPI(format string) int {
+	if format == "wsq" {
+		return wsqDPI
+	}
+	return imageDPI
+}
+
+// checkWSQ rejects a ?format=wsq capture asking for something else than 500
+// dpi, or for a rotate, crop or autocrop, we can't decode wsq to do those
+func checkWSQ(r *http.Request, t transform, resolution int) error {
+	if v := r.URL.Query().Get("dpi"); v != "" && v != fmt.Sprint(wsqDPI) {
+		return fmt.Errorf("wsq is for %d dpi scans, can't tag it with dpi %s", wsqDPI, v)
+	}
+	if resolution != 0 && resolution != wsqDPI {
+		return fmt.Errorf("wsq is for %d dpi scans, can't capture it at resolution %d", wsqDPI, resolution)
+	}
+	if t.rotate != 0 || !t.crop.Empty() || t.autocrop || t.resizes() {
+		return errors.New("wsq captures can't be rotated, cropped or resized")
+	}
+	return nil
+}